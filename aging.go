@@ -0,0 +1,173 @@
+package gu
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// A Waiter for a response that never arrives waits for ever. The main
+// loop can keep track of how long each Waiter has been waiting, to
+// find these.
+
+// WaiterAging is an optional interface for Init. If the Init given to
+// Run implements it, the main loop keeps track of how long each
+// Waiter has been waiting. Each Waiter that waits for longer than
+// MaxWaiterAge is reported once to the Observers as a WaiterAged
+// Event.
+type WaiterAging interface {
+	MaxWaiterAge() time.Duration
+}
+
+// KeyedWaiter is an optional interface for Waiter, which gives it an
+// identity for keeping track of its age. Without it, a Waiter in the
+// state is counted as the same one for as long as it is == to itself,
+// so pointers and comparable values can be tracked, but other values
+// can't. Waiters kept by the main loop are always tracked.
+type KeyedWaiter interface {
+	WaiterKey() string
+}
+
+// WaiterAged is the Event for a Waiter that has been waiting for
+// longer than the maximum age.
+type WaiterAged struct {
+	Waiter Waiter
+	Since  time.Time
+	Time   time.Time
+}
+
+func (WaiterAged) event() {}
+
+// WaiterInfo describes a Waiter, for debugging.
+type WaiterInfo struct {
+	Waiter Waiter `json:"-"`
+
+	// Type is the type of the Waiter, like "main.readingFile".
+	Type string `json:"type"`
+
+	// Since is when the Waiter was first seen. It is zero if the
+	// ages of Waiters are not being tracked, or if this Waiter
+	// can't be.
+	Since time.Time `json:"since"`
+
+	// Once is true for a Waiter kept by the main loop with
+	// WaitOnce, and Always for one kept with WaitAlways. Both are
+	// false for a Waiter in the state.
+	Once   bool `json:"once"`
+	Always bool `json:"always"`
+}
+
+type waiterAge struct {
+	since    time.Time
+	reported bool
+}
+
+type waiterKey struct {
+	typ string
+	key string
+}
+
+// Waiters returns all the Waiters the program has, in the state and
+// kept by the main loop, oldest first.
+func (p *Program) Waiters() []WaiterInfo {
+	l := p.loop
+	infos := l.ask(func(m *machine) interface{} {
+		var infos []WaiterInfo
+		add := func(waiter Waiter, id interface{}, once, always bool) {
+			info := WaiterInfo{
+				Waiter: waiter,
+				Type:   typeName(waiter),
+				Once:   once,
+				Always: always,
+			}
+			if age, ok := l.ages[id]; ok && id != nil {
+				info.Since = age.since
+			}
+			infos = append(infos, info)
+		}
+		for _, waiter := range m.state.Waiters() {
+			add(waiter, waiterIdentity(waiter), false, false)
+		}
+		for _, kept := range m.waiters {
+			add(kept.waiter, kept.id, kept.once, !kept.once)
+		}
+		return infos
+	}).([]WaiterInfo)
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Since.Before(infos[j].Since)
+	})
+	return infos
+}
+
+// WaitersHandler returns an HTTP handler for a debug endpoint, which
+// serves the program's Waiters as JSON.
+func (p *Program) WaitersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Waiters())
+	})
+}
+
+// CheckNoWaiters is for tests. It fails the test if the program still
+// has any Waiters, which means that something is still waiting for
+// an input at the end of the scenario.
+func (p *Program) CheckNoWaiters(tb TB) {
+	tb.Helper()
+	for _, info := range p.Waiters() {
+		tb.Errorf("gu: waiter %s is still waiting", info.Type)
+	}
+}
+
+// eachWaiter calls f with each Waiter and its identity, which is nil
+// if it doesn't have one.
+func (m *machine) eachWaiter(f func(Waiter, interface{})) {
+	for _, waiter := range m.state.Waiters() {
+		f(waiter, waiterIdentity(waiter))
+	}
+	for _, kept := range m.waiters {
+		f(kept.waiter, kept.id)
+	}
+}
+
+func waiterIdentity(waiter Waiter) interface{} {
+	if keyed, ok := waiter.(KeyedWaiter); ok {
+		return waiterKey{typ: typeName(waiter), key: keyed.WaiterKey()}
+	}
+	if reflect.ValueOf(waiter).Comparable() {
+		return waiter
+	}
+	return nil
+}
+
+// age updates when each Waiter was first seen, forgetting the ones
+// that are gone, and reports the ones that are too old.
+func (l *loop) age(m *machine, now time.Time) {
+	if l.maxWaiterAge <= 0 {
+		return
+	}
+
+	ages := make(map[interface{}]*waiterAge, len(l.ages))
+	var aged []WaiterAged
+	m.eachWaiter(func(waiter Waiter, id interface{}) {
+		if id == nil {
+			return
+		}
+		age, ok := l.ages[id]
+		if !ok {
+			age = &waiterAge{since: now}
+		}
+		ages[id] = age
+		if !age.reported && now.Sub(age.since) > l.maxWaiterAge {
+			age.reported = true
+			aged = append(aged, WaiterAged{Waiter: waiter, Since: age.since, Time: now})
+		}
+	})
+	l.ages = ages
+
+	for _, event := range aged {
+		l.observe(event)
+	}
+}
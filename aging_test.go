@@ -0,0 +1,66 @@
+package gu
+
+import (
+	"testing"
+	"time"
+)
+
+type agingStart struct {
+	start
+	maxAge time.Duration
+}
+
+func (a agingStart) MaxWaiterAge() time.Duration { return a.maxAge }
+
+func TestWaiterAging(t *testing.T) {
+	r := &recorder{}
+	p := Start(agingStart{
+		start: start{
+			state:     count{waiters: []Waiter{ticket{"old"}}},
+			outputs:   []Out{WaitOnce(ticket{"kept"})},
+			observers: []Observer{r},
+		},
+		maxAge: 10 * time.Millisecond,
+	})
+	defer p.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(find[WaiterAged](r)) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("aged waiters are %v", find[WaiterAged](r))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Send(inc{})
+	time.Sleep(30 * time.Millisecond)
+	if aged := find[WaiterAged](r); len(aged) != 2 {
+		t.Errorf("waiters were reported more than once: %v", aged)
+	}
+
+	infos := p.Waiters()
+	if len(infos) != 2 || infos[0].Since.IsZero() || infos[1].Since.IsZero() {
+		t.Fatalf("waiters are %+v", infos)
+	}
+}
+
+func TestCheckNoWaiters(t *testing.T) {
+	p := Start(start{state: count{waiters: []Waiter{ticket{"a"}}}})
+	defer p.Stop()
+
+	var waiting fakeTB
+	p.CheckNoWaiters(&waiting)
+	if len(waiting.errors) != 1 {
+		t.Errorf("CheckNoWaiters gave %q", waiting.errors)
+	}
+
+	p.Send(answer{"a"})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Waiters()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	var done fakeTB
+	p.CheckNoWaiters(&done)
+	if len(done.errors) != 0 {
+		t.Errorf("CheckNoWaiters gave %q", done.errors)
+	}
+}
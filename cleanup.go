@@ -0,0 +1,92 @@
+package gu
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// When the state has a fatal error the main loop ends, but first it
+// runs the outputs returned by the update that set the error, along
+// with any cleanup outputs, so that the program can flush files,
+// close connections or say that it is stopping. It waits for all of
+// their Io functions to return, up to a deadline.
+//
+// These outputs are not saved in the Outbox, even if they are
+// Durable, because the input that set the fatal error isn't saved
+// either: a program restarted with the same Outbox starts from the
+// state before it, where the outputs were never returned. So they are
+// run once at most, with Io rather than DurableIo.
+
+// Cleaned is an optional interface for State, for programs that need
+// to tidy up when they fail.
+type Cleaned interface {
+	// CleanupOutputs returns the outputs to run when the state has
+	// a fatal error. It is called on the final state.
+	CleanupOutputs() []Out
+}
+
+// CleanupDeadline is an optional interface for Init, which sets how
+// long the outputs run at the end are given to finish. Without it
+// they are given ten seconds.
+type CleanupDeadline interface {
+	CleanupDeadline() time.Duration
+}
+
+const defaultCleanupDeadline = 10 * time.Second
+
+// cleanup runs the outputs from the fatal transition and the cleanup
+// outputs, and waits for them to finish. An output fails if its Io
+// sends an input that implements error, as for a Job in a Plan, or if
+// it doesn't finish in time.
+func (l *loop) cleanup(state State, outputs []Out) error {
+	if cleaned, ok := state.(Cleaned); ok {
+		n := len(outputs)
+		outputs = append(outputs[:n:n], cleaned.CleanupOutputs()...)
+	}
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	finished := make(chan error, len(outputs))
+	for _, output := range outputs {
+		go func() { finished <- l.finish(output) }()
+	}
+
+	deadline := time.NewTimer(l.cleanupDeadline)
+	defer deadline.Stop()
+	var errs []error
+	for waiting := len(outputs); waiting > 0; waiting-- {
+		select {
+		case err := <-finished:
+			errs = append(errs, err)
+		case <-deadline.C:
+			errs = append(errs, fmt.Errorf("gu: %d outputs did not finish within %s of the fatal error", waiting, l.cleanupDeadline))
+			return errors.Join(errs...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// finish runs an output, and returns once its Io has returned. The
+// inputs it sends are dropped, apart from errors.
+func (l *loop) finish(output Out) error {
+	ch := make(chan In)
+	returned := make(chan struct{})
+	go func() {
+		labelled(output, func() { l.io(output, "", ch, SpanContext{}) })
+		close(returned)
+	}()
+
+	var errs []error
+	for {
+		select {
+		case in := <-ch:
+			if err, failed := in.(error); failed {
+				errs = append(errs, fmt.Errorf("gu: %s failed: %w", typeName(output), err))
+			}
+		case <-returned:
+			return errors.Join(errs...)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package gu
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closing is a count with cleanup outputs.
+type closing struct {
+	count
+	cleanups []Out
+}
+
+func (c closing) CleanupOutputs() []Out { return c.cleanups }
+
+// finale is an input that sets the fatal error and returns its
+// outputs.
+type finale []Out
+
+func (finale) Router(Waiter) Ready { return nil }
+
+func (f finale) Update(s State) (State, []Out) {
+	c := s.(closing)
+	c.n = c.limit
+	return c, f
+}
+
+// flag is an output that sets a flag.
+type flag struct{ set *atomic.Bool }
+
+func (f flag) Io(chan In) { f.set.Store(true) }
+func (flag) Fast() bool   { return false }
+
+// stuck is an output that doesn't return until it is released.
+type stuck struct{ release chan struct{} }
+
+func (s stuck) Io(chan In) { <-s.release }
+func (stuck) Fast() bool   { return false }
+
+// deadline is an Init with a short cleanup deadline.
+type deadline struct{ start }
+
+func (deadline) CleanupDeadline() time.Duration { return 10 * time.Millisecond }
+
+func TestCleanup(t *testing.T) {
+	var last, cleaned atomic.Bool
+	state := closing{count: count{limit: 1}, cleanups: []Out{flag{&cleaned}}}
+	p := Start(start{state: state, outputs: []Out{
+		send{finale{flag{&last}, send{failed{errors.New("disk full")}}}},
+	}})
+	err := wait(t, p)
+	if !errors.Is(err, errDone) {
+		t.Fatalf("got %v", err)
+	}
+	if !strings.Contains(err.Error(), "gu: gu.send failed: disk full") {
+		t.Errorf("the failed output isn't in %q", err)
+	}
+	if !last.Load() || !cleaned.Load() {
+		t.Errorf("last output ran: %v, cleanup output ran: %v", last.Load(), cleaned.Load())
+	}
+}
+
+func TestCleanupDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	state := closing{count: count{limit: 1}, cleanups: []Out{stuck{release}}}
+	p := Start(deadline{start{state: state, outputs: []Out{send{finale{}}}}})
+	err := wait(t, p)
+	if !errors.Is(err, errDone) || !strings.Contains(err.Error(), "1 outputs did not finish within 10ms") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// refund is a Durable output that records how it was run.
+type refund struct{ io, durableIo *atomic.Bool }
+
+func (r refund) Io(chan In) { r.io.Store(true) }
+func (refund) Fast() bool   { return false }
+
+func (r refund) DurableIo(chan In, string) error {
+	r.durableIo.Store(true)
+	return errors.New("refund failed")
+}
+
+func TestCleanupNotSaved(t *testing.T) {
+	outbox, err := OpenFileOutbox(filepath.Join(t.TempDir(), "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+
+	var io, durableIo atomic.Bool
+	state := closing{count: count{limit: 1}}
+	p := Start(outboxStart{start{state: state, outputs: []Out{send{finale{refund{&io, &durableIo}}}}}, outbox})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	if !io.Load() || durableIo.Load() {
+		t.Errorf("Io ran: %v, DurableIo ran: %v", io.Load(), durableIo.Load())
+	}
+	if _, pending, _ := outbox.Pending(); len(pending) != 0 {
+		t.Errorf("the outbox has %v", pending)
+	}
+}
@@ -0,0 +1,40 @@
+package gu
+
+import (
+	"runtime"
+)
+
+// Compute returns an output for expensive pure work, like parsing a
+// big document. Updates run on the main loop, so doing the work in
+// an update would hold up every other message. Instead the update
+// can return Compute(f), and f is run on a pool of worker goroutines,
+// one for each CPU. The In that f returns is sent to the main loop
+// like any other input.
+//
+// f must be pure, like an update. Since its result comes back as an
+// ordinary input, a recording of the program's inputs has the result
+// in it, so replaying the recording doesn't need to run f again.
+func Compute(f func() In) Out {
+	return compute{f: f}
+}
+
+type compute struct {
+	f func() In
+}
+
+// workers limits how many Compute functions run at once.
+var workers = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+func (c compute) Io(ch chan In) {
+	ch <- c.run()
+}
+
+func (c compute) run() In {
+	workers <- struct{}{}
+	defer func() { <-workers }()
+	return c.f()
+}
+
+func (compute) Fast() bool {
+	return false
+}
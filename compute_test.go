@@ -0,0 +1,37 @@
+package gu
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompute(t *testing.T) {
+	const n = 20
+	var running, most atomic.Int32
+	f := func() In {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			old := most.Load()
+			if now <= old || most.CompareAndSwap(old, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return inc{}
+	}
+
+	outputs := make([]Out, n)
+	for i := range outputs {
+		outputs[i] = Compute(f)
+	}
+	p := Start(start{state: count{limit: n}, outputs: outputs})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	if m := int(most.Load()); m > runtime.GOMAXPROCS(0) {
+		t.Errorf("%d ran at once on %d CPUs", m, runtime.GOMAXPROCS(0))
+	}
+}
@@ -0,0 +1,198 @@
+package gu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An input that no Waiter claims is processed by In.Update, and if
+// that does nothing with it then it is lost without a trace. This
+// happens, for example, to a response that arrives after the process
+// that asked for it has given up. Such inputs can be made visible as
+// dead letters, which are reported to the Observers as an Event, and
+// can be given to a DeadLetterHandler.
+
+// Required is an optional interface for In, for inputs that should
+// always be claimed by a Waiter. If none of them claims it, it is
+// still processed by In.Update, but it is also a dead letter.
+type Required interface {
+	NeedsWaiter() bool
+}
+
+// ErrUnclaimed is the Reason for a dead letter that was Required but
+// not claimed by any Waiter.
+var ErrUnclaimed = errors.New("gu: input was not claimed by any waiter")
+
+// Reject returns an instruction to the main loop to make the input
+// being processed into a dead letter, for the reason given. It is
+// for updates that can't do anything with the input they are given.
+func Reject(reason error) Out {
+	return directive(func(m *machine) {
+		m.rejected = reason
+	})
+}
+
+// DeadLetter is an input that was rejected by its update, or was
+// Required but not claimed by any Waiter. It is an Event. In is nil
+// if Reject was one of the initial outputs.
+type DeadLetter struct {
+	In     In
+	Reason error
+	Time   time.Time
+}
+
+func (DeadLetter) event() {}
+
+// DeadLetterHandler is an optional interface for Init. If the Init
+// given to Run implements it, then each dead letter is given to
+// HandleDeadLetter, and the In it returns, if it isn't nil, is
+// processed by the main loop next. The In returned should not be able
+// to become a dead letter itself, or it may go round for ever.
+type DeadLetterHandler interface {
+	HandleDeadLetter(DeadLetter) In
+}
+
+// DeadLetterSink is somewhere to send dead letters, such as a log.
+type DeadLetterSink interface {
+	Send(DeadLetter)
+}
+
+// DeadLetters is an Observer that counts dead letters by the type of
+// their input, and sends each one to a sink.
+type DeadLetters struct {
+	sink DeadLetterSink
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewDeadLetters makes a DeadLetters that sends to the sink, which
+// can be nil if only the counts are wanted.
+func NewDeadLetters(sink DeadLetterSink) *DeadLetters {
+	return &DeadLetters{sink: sink, counts: make(map[string]int)}
+}
+
+// Observe counts and sends on the dead letters. Other kinds of Event
+// are ignored.
+func (d *DeadLetters) Observe(event Event) {
+	letter, ok := event.(DeadLetter)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	d.counts[typeName(letter.In)]++
+	d.mu.Unlock()
+
+	if d.sink != nil {
+		d.sink.Send(letter)
+	}
+}
+
+// Counts returns the number of dead letters so far for each type of
+// input.
+func (d *DeadLetters) Counts() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	counts := make(map[string]int, len(d.counts))
+	for name, count := range d.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// WriteCounts writes the counts as lines of text, like
+// "main.fileRead 3", in order of type name.
+func (d *DeadLetters) WriteCounts(w io.Writer) error {
+	counts := d.Counts()
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, err := fmt.Fprintf(w, "%s %d\n", name, counts[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogSink sends dead letters to a logger.
+func LogSink(logger *log.Logger) DeadLetterSink {
+	return logSink{logger: logger}
+}
+
+type logSink struct {
+	logger *log.Logger
+}
+
+func (s logSink) Send(letter DeadLetter) {
+	s.logger.Printf(
+		"gu: dead letter %s: %v: %+v",
+		typeName(letter.In), letter.Reason, letter.In)
+}
+
+// JSONSink writes each dead letter as a line of JSON, which is
+// usually to a file.
+func JSONSink(w io.Writer) DeadLetterSink {
+	return &jsonSink{w: w}
+}
+
+type jsonSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *jsonSink) Send(letter DeadLetter) {
+	line, err := json.Marshal(struct {
+		Type   string    `json:"type"`
+		Reason string    `json:"reason"`
+		Time   time.Time `json:"time"`
+		In     string    `json:"in"`
+	}{
+		Type:   typeName(letter.In),
+		Reason: letter.Reason.Error(),
+		Time:   letter.Time,
+		In:     fmt.Sprintf("%+v", letter.In),
+	})
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(line, '\n'))
+}
+
+// deadLetter decides if the input that has just been processed is a
+// dead letter.
+func (m *machine) deadLetter(in In, claimed Waiter) (DeadLetter, bool) {
+	if m.rejected != nil {
+		return DeadLetter{In: in, Reason: m.rejected}, true
+	}
+	required, ok := in.(Required)
+	if ok && claimed == nil && required.NeedsWaiter() {
+		return DeadLetter{In: in, Reason: ErrUnclaimed}, true
+	}
+	return DeadLetter{}, false
+}
+
+func (l *loop) deadLetter(letter DeadLetter) {
+	letter.Time = time.Now()
+	l.observe(letter)
+	if l.deadLetters == nil {
+		return
+	}
+	if in := l.deadLetters.HandleDeadLetter(letter); in != nil {
+		l.pending = append(l.pending, message{in: in})
+	}
+}
@@ -0,0 +1,77 @@
+package gu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+// stray is a Required input that counts even though it is unclaimed.
+type stray struct{}
+
+func (stray) Router(Waiter) Ready { return nil }
+func (stray) NeedsWaiter() bool   { return true }
+
+func (stray) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.n++
+	return c, nil
+}
+
+// refused is an input that its update rejects.
+type refused struct{}
+
+func (refused) Router(Waiter) Ready { return nil }
+
+func (refused) Update(s State) (State, []Out) {
+	return s, []Out{Reject(errors.New("refused"))}
+}
+
+// retried is an Init that turns each dead letter into an inc.
+type retried struct{ start }
+
+func (retried) HandleDeadLetter(DeadLetter) In { return inc{} }
+
+func TestDeadLetters(t *testing.T) {
+	var logged, lines bytes.Buffer
+	letters := NewDeadLetters(LogSink(log.New(&logged, "", 0)))
+	p := Start(retried{start{
+		state:   count{limit: 4},
+		outputs: []Out{send{stray{}}, send{refused{}}, send{answer{"x"}}},
+		observers: []Observer{
+			letters,
+			NewDeadLetters(JSONSink(&lines)),
+		},
+	}})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+
+	counts := letters.Counts()
+	if counts["gu.stray"] != 1 || counts["gu.refused"] != 1 || len(counts) != 2 {
+		t.Errorf("counts are %v", counts)
+	}
+	var written bytes.Buffer
+	letters.WriteCounts(&written)
+	if written.String() != "gu.refused 1\ngu.stray 1\n" {
+		t.Errorf("WriteCounts wrote %q", written.String())
+	}
+	if !strings.Contains(logged.String(), "gu: dead letter gu.refused: refused") {
+		t.Errorf("logged %q", logged.String())
+	}
+
+	reasons := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(lines.String()), "\n") {
+		var letter struct{ Type, Reason string }
+		if err := json.Unmarshal([]byte(line), &letter); err != nil {
+			t.Fatal(err)
+		}
+		reasons[letter.Type] = letter.Reason
+	}
+	if reasons["gu.stray"] != ErrUnclaimed.Error() || reasons["gu.refused"] != "refused" {
+		t.Errorf("reasons are %v", reasons)
+	}
+}
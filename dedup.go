@@ -0,0 +1,150 @@
+package gu
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// Idempotent is an optional interface for In, for inputs from outside
+// systems that may deliver the same message more than once, such as
+// webhooks or message queues. If the program has an Inbox then an
+// input with the same key as one it has already processed is dropped
+// before the state is updated with it. An empty key means the input
+// is always processed.
+type Idempotent interface {
+	IdempotencyKey() string
+}
+
+// Deduplicated is an optional interface for Init, which gives the
+// Inbox for dropping repeated inputs.
+type Deduplicated interface {
+	Inbox() *Inbox
+}
+
+// Duplicate is the Event for the main loop dropping an input because
+// its key is in the Inbox.
+type Duplicate struct {
+	In   In
+	Key  string
+	Time time.Time
+}
+
+func (Duplicate) event() {}
+
+// Inbox remembers the keys of the latest Idempotent inputs, up to a
+// fixed number of them. The main loop drops any input whose key it
+// has. It can be saved to a file, so that it lasts over restarts.
+type Inbox struct {
+	mu sync.Mutex
+
+	// keys is a ring of the latest keys, and next is where the
+	// next one goes.
+	keys []string
+	next int
+	has  map[string]bool
+
+	duplicates uint64
+}
+
+// NewInbox makes an empty Inbox that remembers up to size keys.
+func NewInbox(size int) *Inbox {
+	return &Inbox{
+		keys: make([]string, 0, size),
+		has:  make(map[string]bool, size),
+	}
+}
+
+// LoadInbox reads an Inbox saved by Save, or makes an empty one if
+// the file doesn't exist. If the file has more than size keys then
+// only the latest are kept.
+func LoadInbox(path string, size int) (*Inbox, error) {
+	b := NewInbox(size)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		b.seen(key)
+	}
+	return b, nil
+}
+
+// Save writes the keys to a file, oldest first. The file is replaced
+// in one step, so it is never left half written.
+func (b *Inbox) Save(path string) error {
+	b.mu.Lock()
+	keys := append(b.keys[b.next:len(b.keys):len(b.keys)], b.keys[:b.next]...)
+	b.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(keys); err != nil {
+		return err
+	}
+	if err := writeFile(path+".tmp", buf.Bytes()); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Duplicates returns how many inputs have been dropped, for reporting
+// as a metric.
+func (b *Inbox) Duplicates() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.duplicates
+}
+
+// seen reports whether the key is in the Inbox, and adds it if not.
+func (b *Inbox) seen(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.has[key] {
+		b.duplicates++
+		return true
+	}
+	if cap(b.keys) == 0 {
+		return false
+	}
+
+	if len(b.keys) < cap(b.keys) {
+		b.keys = append(b.keys, key)
+	} else {
+		delete(b.has, b.keys[b.next])
+		b.keys[b.next] = key
+	}
+	b.next = (b.next + 1) % cap(b.keys)
+	b.has[key] = true
+	return false
+}
+
+// duplicate reports whether an input should be dropped, and tells the
+// Observers if so.
+func (l *loop) duplicate(in In) bool {
+	if l.inbox == nil {
+		return false
+	}
+	idempotent, ok := in.(Idempotent)
+	if !ok {
+		return false
+	}
+	key := idempotent.IdempotencyKey()
+	if key == "" || !l.inbox.seen(key) {
+		return false
+	}
+	l.observe(Duplicate{In: in, Key: key, Time: time.Now()})
+	return true
+}
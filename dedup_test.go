@@ -0,0 +1,83 @@
+package gu
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// delivery is an inc with an idempotency key.
+type delivery struct {
+	inc
+	key string
+}
+
+func (d delivery) IdempotencyKey() string { return d.key }
+
+// deduplicated is an Init with an Inbox.
+type deduplicated struct {
+	start
+	inbox *Inbox
+}
+
+func (d deduplicated) Inbox() *Inbox { return d.inbox }
+
+func TestInboxDropsRepeats(t *testing.T) {
+	r := &recorder{}
+	inbox := NewInbox(10)
+	p := Start(deduplicated{start{state: count{}, observers: []Observer{r}}, inbox})
+	for _, key := range []string{"a", "b", "a", "", "", "b"} {
+		p.Send(delivery{key: key})
+	}
+	p.Send(inc{})
+	eventually(t, p, 5)
+	p.Stop()
+	wait(t, p)
+
+	if inbox.Duplicates() != 2 {
+		t.Errorf("%d duplicates", inbox.Duplicates())
+	}
+	duplicates := find[Duplicate](r)
+	if len(duplicates) != 2 || duplicates[0].Key != "a" || duplicates[1].Key != "b" {
+		t.Errorf("events are %+v", duplicates)
+	}
+}
+
+func TestInboxForgetsOldest(t *testing.T) {
+	inbox := NewInbox(2)
+	for _, key := range []string{"a", "b", "c"} {
+		inbox.seen(key)
+	}
+	if inbox.seen("a") {
+		t.Error("a was remembered past the size")
+	}
+	if !inbox.seen("c") {
+		t.Error("c was forgotten")
+	}
+}
+
+func TestSaveInbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inbox")
+	empty, err := LoadInbox(path, 3)
+	if err != nil || len(empty.keys) != 0 {
+		t.Fatalf("got %v, %v", empty.keys, err)
+	}
+
+	inbox := NewInbox(3)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		inbox.seen(key)
+	}
+	if err := inbox.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading into a smaller Inbox keeps the latest keys.
+	loaded, err := LoadInbox(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"b": false, "c": true, "d": true} {
+		if loaded.has[key] != want {
+			t.Errorf("has %q is %v", key, loaded.has[key])
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package gu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The sizes of the parts of a crash bundle are limited, so that
+// recording is cheap enough to leave on all the time, and a crash
+// with a huge state doesn't fill the disk.
+const (
+	maxEventText = 1 << 10
+	maxStateText = 1 << 20
+	maxStackText = 4 << 20
+)
+
+// FlightRecorder is an Observer that remembers the latest events in
+// memory, so that there is a record of how a program got into
+// trouble. When the main loop ends with an error, or an update or an
+// output panics, it writes a crash bundle to a file, with the events,
+// the state and a dump of all the goroutines.
+//
+// Each event is kept as text, which is cut short as it is written if
+// it is long, so the memory and time it uses are limited however big
+// the event is.
+type FlightRecorder struct {
+	dir string
+
+	mu sync.Mutex
+
+	// events is a ring of the latest events, and next is where the
+	// next one goes.
+	events []string
+	next   int
+
+	bundle string
+	err    error
+}
+
+// NewFlightRecorder makes a FlightRecorder that remembers up to size
+// events, and writes crash bundles in dir.
+func NewFlightRecorder(size int, dir string) *FlightRecorder {
+	return &FlightRecorder{
+		dir:    dir,
+		events: make([]string, 0, size),
+	}
+}
+
+// Observe records the event, and writes a crash bundle if the program
+// has failed.
+func (f *FlightRecorder) Observe(e Event) {
+	f.record(e)
+
+	switch e := e.(type) {
+	case Stopped:
+		if e.Err != nil {
+			f.dump(e.Err.Error(), e.State)
+		}
+	case Panicked:
+		reason := fmt.Sprintf("panic: %v\n\n%s", e.Value, e.Stack)
+		if e.Out != nil {
+			reason = fmt.Sprintf("panic in the Io of %s: %v\n\n%s", typeName(e.Out), e.Value, e.Stack)
+		}
+		f.dump(reason, e.State)
+	}
+}
+
+func (f *FlightRecorder) record(e Event) {
+	line := time.Now().Format(time.RFC3339Nano) + " " + typeName(e) + " " +
+		boundedText(e, maxEventText)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cap(f.events) == 0 {
+		return
+	}
+	if len(f.events) < cap(f.events) {
+		f.events = append(f.events, line)
+	} else {
+		f.events[f.next] = line
+	}
+	f.next = (f.next + 1) % cap(f.events)
+}
+
+// WriteEvents writes the events that have been recorded, oldest first,
+// one to a line. It is for looking at a program that is still running.
+func (f *FlightRecorder) WriteEvents(w io.Writer) error {
+	f.mu.Lock()
+	events := append(f.events[f.next:len(f.events):len(f.events)], f.events[:f.next]...)
+	f.mu.Unlock()
+
+	for _, event := range events {
+		if _, err := fmt.Fprintln(w, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bundle returns the path of the last crash bundle written, or "" if
+// there hasn't been one.
+func (f *FlightRecorder) Bundle() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bundle
+}
+
+// Err returns the error from writing the last crash bundle, if there
+// was one.
+func (f *FlightRecorder) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// dump writes a crash bundle. The state is nil if it isn't known.
+func (f *FlightRecorder) dump(reason string, state State) {
+	now := time.Now()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "gu crash bundle\ntime: %s\n\n%s\n", now.Format(time.RFC3339Nano), reason)
+
+	fmt.Fprintf(&buf, "\nrecent events, oldest first:\n")
+	f.WriteEvents(&buf)
+
+	fmt.Fprintf(&buf, "\nstate:\n")
+	if state == nil {
+		fmt.Fprintf(&buf, "not known\n")
+	} else {
+		fmt.Fprintf(&buf, "%s\n", boundedText(state, maxStateText))
+	}
+
+	fmt.Fprintf(&buf, "\ngoroutines:\n%s\n", limit(string(allStacks()), maxStackText))
+
+	path := filepath.Join(f.dir, "gu-crash-"+now.Format("20060102T150405.000000000")+".txt")
+	err := os.WriteFile(path, buf.Bytes(), 0o644)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+	if err == nil {
+		f.bundle = path
+	}
+}
+
+// limit cuts a string short if it is longer than n bytes.
+func limit(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "... (cut short)"
+}
+
+// boundedText writes a value as text, like %+v, but stops once it has
+// written n bytes, so that a huge value is not formatted in full only
+// to be cut short.
+func boundedText(v interface{}, n int) string {
+	p := &boundedPrinter{n: n}
+	p.value(reflect.ValueOf(v), 0)
+	if p.cut {
+		p.buf.WriteString("... (cut short)")
+	}
+	return p.buf.String()
+}
+
+// maxTextDepth is how deep boundedText goes into a value, which also
+// stops it going round a cycle of pointers for ever.
+const maxTextDepth = 10
+
+type boundedPrinter struct {
+	buf bytes.Buffer
+	n   int
+	cut bool
+}
+
+// write adds s to the text, and returns false once the text is full.
+func (p *boundedPrinter) write(s string) bool {
+	if p.cut {
+		return false
+	}
+	if room := p.n - p.buf.Len(); len(s) > room {
+		p.buf.WriteString(s[:room])
+		p.cut = true
+		return false
+	}
+	p.buf.WriteString(s)
+	return true
+}
+
+func (p *boundedPrinter) value(v reflect.Value, depth int) {
+	if p.cut {
+		return
+	}
+	if !v.IsValid() {
+		p.write("<nil>")
+		return
+	}
+	if depth > maxTextDepth {
+		p.write("...")
+		return
+	}
+	if text, ok := describe(v); ok {
+		p.write(text)
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			p.write("<nil>")
+			return
+		}
+		if v.Kind() == reflect.Pointer {
+			p.write("&")
+		}
+		p.value(v.Elem(), depth+1)
+
+	case reflect.Struct:
+		p.write("{")
+		for i := 0; i < v.NumField() && !p.cut; i++ {
+			if i > 0 {
+				p.write(" ")
+			}
+			p.write(v.Type().Field(i).Name + ":")
+			p.value(v.Field(i), depth+1)
+		}
+		p.write("}")
+
+	case reflect.Slice, reflect.Array:
+		p.write("[")
+		for i := 0; i < v.Len() && !p.cut; i++ {
+			if i > 0 {
+				p.write(" ")
+			}
+			p.value(v.Index(i), depth+1)
+		}
+		p.write("]")
+
+	case reflect.Map:
+		p.write("map[")
+		for i, iter := 0, v.MapRange(); iter.Next() && !p.cut; i++ {
+			if i > 0 {
+				p.write(" ")
+			}
+			p.value(iter.Key(), depth+1)
+			p.write(":")
+			p.value(iter.Value(), depth+1)
+		}
+		p.write("]")
+
+	case reflect.String:
+		p.write(v.String())
+
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		p.write(v.Type().String())
+
+	default:
+		p.write(fmt.Sprint(v))
+	}
+}
+
+// describe returns the text of a value that is an error or a
+// fmt.Stringer. Like fmt, it treats a panic as the text.
+func describe(v reflect.Value) (text string, ok bool) {
+	if v.Kind() == reflect.Interface || !v.CanInterface() {
+		return "", false
+	}
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return "", false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			text, ok = fmt.Sprintf("(PANIC=%v)", r), true
+		}
+	}()
+	switch x := v.Interface().(type) {
+	case error:
+		return x.Error(), true
+	case fmt.Stringer:
+		return x.String(), true
+	}
+	return "", false
+}
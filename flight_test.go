@@ -0,0 +1,94 @@
+package gu
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// big is an input that is slow to format in full.
+type big struct {
+	items []int
+	index map[int]string
+}
+
+func (big) Router(Waiter) Ready           { return nil }
+func (big) Update(s State) (State, []Out) { return s, nil }
+
+func TestFlightRecorderEvents(t *testing.T) {
+	f := NewFlightRecorder(2, t.TempDir())
+	b := big{items: make([]int, 1<<20), index: make(map[int]string)}
+	for i := 0; i < 1<<16; i++ {
+		b.index[i] = "x"
+	}
+	for _, n := range []int{1, 2, 3} {
+		f.Observe(Received{In: num(n), Time: time.Now()})
+	}
+
+	begin := time.Now()
+	f.Observe(Received{In: b})
+	if took := time.Since(begin); took > 100*time.Millisecond {
+		t.Errorf("recording a big event took %s", took)
+	}
+
+	var buf bytes.Buffer
+	f.WriteEvents(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d events, expected 2", len(lines))
+	}
+	if !strings.Contains(lines[0], "gu.Received {In:3 Time:") {
+		t.Errorf("first event is %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "... (cut short)") || len(lines[1]) > maxEventText+100 {
+		t.Errorf("big event is %d bytes: %.100q", len(lines[1]), lines[1])
+	}
+}
+
+func TestBoundedText(t *testing.T) {
+	type node struct {
+		Name string
+		next *node
+		err  error
+	}
+	cycle := &node{Name: "a", err: errors.New("broken")}
+	cycle.next = cycle
+
+	text := boundedText(cycle, 1000)
+	if !strings.HasPrefix(text, "&{Name:a next:&{Name:a next:") || !strings.Contains(text, "broken") {
+		t.Errorf("got %q", text)
+	}
+	if text := boundedText([]string{"abc", "def"}, 6); text != "[abc d... (cut short)" {
+		t.Errorf("got %q", text)
+	}
+	if text := boundedText(nil, 10); text != "<nil>" {
+		t.Errorf("got %q", text)
+	}
+}
+
+func TestFlightRecorderBundle(t *testing.T) {
+	f := NewFlightRecorder(10, t.TempDir())
+	p := Start(start{
+		state:     count{limit: 1},
+		outputs:   []Out{send{num(1)}},
+		observers: []Observer{f},
+	})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	if f.Err() != nil {
+		t.Fatal(f.Err())
+	}
+	bundle, err := os.ReadFile(f.Bundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"\ndone\n", "gu.Transition", "state:\n{n:1 limit:1 waiters:[]}", "goroutines:\n"} {
+		if !bytes.Contains(bundle, []byte(part)) {
+			t.Errorf("bundle doesn't have %q", part)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package gu
+
+import (
+	"iter"
+)
+
+// FlowFunc is a sequential process written as one function, instead
+// of as a chain of Waiter and Ready types. It talks to the main loop
+// through the Co it is given: Co.Await hands over IO actions and
+// pauses the function until the input it is waiting for arrives.
+//
+// Like an update, a FlowFunc should not contain any IO code. It is
+// run as a coroutine with iter.Pull, on the main loop's goroutine,
+// so there is no goroutine for each flow.
+type FlowFunc func(*Co)
+
+// Co is a flow's connection to the main loop.
+type Co struct {
+	state   State
+	outputs []Out
+	want    func(In) bool
+	in      In
+	yield   func(struct{}) bool
+}
+
+// Flow is a running FlowFunc. It is a Waiter, so it should be kept in
+// the state and returned by State.Waiters until it is Done, or given
+// to WaitAlways, which removes it once it is Done.
+//
+// Unlike most Waiters a Flow is changed when its Ready is updated,
+// so each Ready it makes must only be updated once, and a state that
+// is kept after it has been updated needs a Copy of the Flow.
+type Flow struct {
+	// f and start are the FlowFunc and the state it was started
+	// with, for Copy.
+	f     FlowFunc
+	start State
+
+	co    *Co
+	next  func() (struct{}, bool)
+	stop  func()
+	done  bool
+	steps []FlowStep
+}
+
+// FlowStep is an input that a flow was given, along with the global
+// state it was resumed with, which Co.State returned until the flow
+// next waited.
+type FlowStep struct {
+	In    In
+	State State
+}
+
+// flowStopped is panicked by Co.Await to unwind a flow that has been
+// stopped.
+type flowStopped struct{}
+
+// StartFlow starts a flow running. It runs until the flow first
+// waits for an input, or ends, and returns the new state and the
+// outputs the flow has asked for so far.
+func StartFlow(f FlowFunc, state State) (*Flow, State, []Out) {
+	flow := &Flow{f: f, start: state, co: &Co{}}
+	flow.next, flow.stop = iter.Pull(func(yield func(struct{}) bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(flowStopped); !ok {
+					panic(r)
+				}
+			}
+		}()
+		flow.co.yield = yield
+		f(flow.co)
+	})
+	state, outputs := flow.resume(state)
+	return flow, state, outputs
+}
+
+// ReplayFlow rebuilds a flow from the steps it had taken, as returned
+// by Flow.Steps. Since a FlowFunc is pure, and it is given the same
+// inputs and states as before, this puts it back where it was, so it
+// is a way of taking a snapshot of a flow. state is the state it was
+// started with. The outputs asked for while replaying, and the states
+// it leaves, are dropped, since they have already had their effect.
+func ReplayFlow(f FlowFunc, state State, steps []FlowStep) *Flow {
+	flow, _, _ := StartFlow(f, state)
+	for _, step := range steps {
+		ready, ok := flow.Expected(step.In)
+		if !ok {
+			break
+		}
+		ready.Update(step.State)
+	}
+	return flow
+}
+
+// Await adds some IO actions to be run, then pauses the flow until
+// an input that want accepts arrives, and returns it.
+func (c *Co) Await(want func(In) bool, outputs ...Out) In {
+	c.Emit(outputs...)
+	c.want = want
+	if !c.yield(struct{}{}) {
+		panic(flowStopped{})
+	}
+	return c.in
+}
+
+// Emit adds some IO actions to be run, without waiting for anything.
+func (c *Co) Emit(outputs ...Out) {
+	c.outputs = append(c.outputs, outputs...)
+}
+
+// State returns the global state of the program.
+func (c *Co) State() State {
+	return c.state
+}
+
+// SetState replaces the global state of the program.
+func (c *Co) SetState(state State) {
+	c.state = state
+}
+
+// Expected decides if the flow is waiting for the input.
+func (f *Flow) Expected(in In) (Ready, bool) {
+	if f.done || !f.co.want(in) {
+		return nil, false
+	}
+	return flowReady{flow: f, in: in}, true
+}
+
+// Done reports whether the flow has ended, so it can be removed from
+// the state.
+func (f *Flow) Done() bool {
+	return f.done
+}
+
+// Stop ends a flow that is no longer wanted, which frees the memory
+// used by its coroutine. The FlowFunc doesn't run any further than
+// the Await it is paused in.
+func (f *Flow) Stop() {
+	f.done = true
+	f.stop()
+}
+
+// Steps returns the inputs the flow has been given so far, with the
+// states it was resumed with, for use with ReplayFlow.
+func (f *Flow) Steps() []FlowStep {
+	return f.steps
+}
+
+// Copy returns a copy of the flow, which carries on separately. It is
+// made by replaying the flow's steps, as with ReplayFlow.
+func (f *Flow) Copy() *Flow {
+	flow := ReplayFlow(f.f, f.start, f.steps)
+	if f.done && !flow.done {
+		flow.Stop()
+	}
+	return flow
+}
+
+// resume runs the flow until it next waits or ends.
+func (f *Flow) resume(state State) (State, []Out) {
+	f.co.state = state
+	f.co.outputs = nil
+	if _, ok := f.next(); !ok {
+		f.done = true
+	}
+	state, outputs := f.co.state, f.co.outputs
+	f.co.state, f.co.outputs = nil, nil
+	return state, outputs
+}
+
+type flowReady struct {
+	flow *Flow
+	in   In
+}
+
+func (r flowReady) Update(state State) (State, []Out) {
+	r.flow.steps = append(r.flow.steps, FlowStep{In: r.in, State: state})
+	r.flow.co.in = r.in
+	return r.flow.resume(state)
+}
@@ -0,0 +1,102 @@
+package gu
+
+import (
+	"fmt"
+	"testing"
+)
+
+// greet is a flow that asks for a name and then greets it.
+func greet(co *Co) {
+	name := co.Await(func(in In) bool { _, ok := in.(word); return ok }, send{word("who?")})
+	co.Emit(send{"hello " + name.(word)})
+}
+
+func TestFlow(t *testing.T) {
+	flow, _, outputs := StartFlow(greet, nil)
+	if len(outputs) != 1 || outputs[0] != (send{word("who?")}) {
+		t.Fatalf("started with %v", outputs)
+	}
+	if _, ok := flow.Expected(inc{}); ok {
+		t.Error("the flow expected an inc")
+	}
+
+	ready, ok := flow.Expected(word("bob"))
+	if !ok {
+		t.Fatal("the flow didn't expect a word")
+	}
+	_, outputs = ready.Update(nil)
+	if len(outputs) != 1 || outputs[0] != (send{word("hello bob")}) {
+		t.Errorf("ended with %v", outputs)
+	}
+	if !flow.Done() {
+		t.Error("the flow isn't done")
+	}
+	if _, ok := flow.Expected(word("alice")); ok {
+		t.Error("a done flow expected a word")
+	}
+}
+
+func TestFlowState(t *testing.T) {
+	flow, state, _ := StartFlow(awaitWords, flowing{})
+	for _, w := range []word{"a", "b"} {
+		ready, ok := flow.Expected(w)
+		if !ok {
+			t.Fatalf("the flow didn't expect %q", w)
+		}
+		state, _ = ready.Update(state)
+	}
+	if n := state.(flowing).n; n != 2 || !flow.Done() {
+		t.Errorf("got %d, done is %v", n, flow.Done())
+	}
+}
+
+func TestReplayFlow(t *testing.T) {
+	flow, state, _ := StartFlow(awaitWords, flowing{})
+	ready, _ := flow.Expected(word("a"))
+	ready.Update(state)
+
+	replayed := ReplayFlow(awaitWords, flowing{}, flow.Steps())
+	if _, ok := replayed.Expected(word("a")); ok {
+		t.Error("the replayed flow still expected a")
+	}
+	if _, ok := replayed.Expected(word("b")); !ok {
+		t.Error("the replayed flow didn't expect b")
+	}
+}
+
+// awaitCount is a flow that waits for go, and then for a word that is
+// the count in the state at that time.
+func awaitCount(co *Co) {
+	co.Await(func(in In) bool { return in == word("go") })
+	n := word(fmt.Sprint(co.State().(flowing).n))
+	co.Await(func(in In) bool { return in == n })
+}
+
+func TestCopyFlowReadingState(t *testing.T) {
+	flow, _, _ := StartFlow(awaitCount, flowing{})
+
+	// Another input has changed the count since the flow started.
+	ready, _ := flow.Expected(word("go"))
+	ready.Update(flowing{n: 5})
+
+	for _, f := range []*Flow{flow.Copy(), ReplayFlow(awaitCount, flowing{}, flow.Steps())} {
+		if _, ok := f.Expected(word("5")); !ok {
+			t.Error("the copy didn't read the state the flow read")
+		}
+	}
+}
+
+func TestStopFlow(t *testing.T) {
+	reached := false
+	flow, _, _ := StartFlow(func(co *Co) {
+		co.Await(func(In) bool { return true })
+		reached = true
+	}, nil)
+	flow.Stop()
+	if !flow.Done() {
+		t.Error("a stopped flow isn't done")
+	}
+	if _, ok := flow.Expected(inc{}); ok || reached {
+		t.Error("a stopped flow carried on")
+	}
+}
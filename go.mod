@@ -0,0 +1,3 @@
+module github.com/8n8/gu
+
+go 1.24
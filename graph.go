@@ -0,0 +1,218 @@
+package gu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Graph is a diagram of how messages flow through a program. It
+// links the types of the inputs to the Waiters or In.Update
+// functions that handle them, those to the types of the outputs they
+// return, and the outputs to the types of the inputs their Io sends.
+// Each link is counted, so the busiest paths can be picked out.
+//
+// Graph is an Observer, so it can be filled in by running the
+// program, or by giving it the Events from a recorded run. The zero
+// value is an empty Graph ready to use.
+type Graph struct {
+	mu    sync.Mutex
+	edges map[graphEdge]int
+}
+
+type graphEdge struct {
+	from graphNode
+	to   graphNode
+}
+
+type graphNode struct {
+	kind nodeKind
+	name string
+}
+
+type nodeKind int
+
+const (
+	inNode nodeKind = iota
+	handlerNode
+	outNode
+)
+
+// Observe adds the links made by a Transition to the graph. Other
+// kinds of Event are ignored.
+func (g *Graph) Observe(event Event) {
+	transition, ok := event.(Transition)
+	if !ok {
+		return
+	}
+
+	in := graphNode{inNode, typeName(transition.In)}
+	handler := graphNode{handlerNode, in.name + ".Update"}
+	if transition.Waiter != nil {
+		handler = graphNode{handlerNode, typeName(transition.Waiter)}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.edges == nil {
+		g.edges = make(map[graphEdge]int)
+	}
+	if transition.Cause != nil {
+		cause := graphNode{outNode, typeName(transition.Cause)}
+		g.edges[graphEdge{cause, in}]++
+	}
+	g.edges[graphEdge{in, handler}]++
+	for _, output := range transition.Outputs {
+		g.edges[graphEdge{handler, graphNode{outNode, typeName(output)}}]++
+	}
+}
+
+// WriteDot writes the graph in the Graphviz DOT language. The hot
+// paths, the links used at least half as often as the busiest one,
+// are drawn thick and red.
+func (g *Graph) WriteDot(w io.Writer) error {
+	nodes, edges, max := g.snapshot()
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph gu {")
+	for _, node := range nodes {
+		fmt.Fprintf(
+			b, "\t%s [label=%s shape=%s];\n",
+			strconv.Quote(node.id()), strconv.Quote(node.name), node.shape())
+	}
+	for _, edge := range edges {
+		count := edge.count
+		width := 1 + 4*float64(count)/float64(max)
+		colour := "black"
+		if isHot(count, max) {
+			colour = "red"
+		}
+		fmt.Fprintf(
+			b, "\t%s -> %s [label=%d penwidth=%.1f color=%s];\n",
+			strconv.Quote(edge.from.id()), strconv.Quote(edge.to.id()),
+			count, width, colour)
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart. The hot
+// paths are drawn with thick arrows.
+func (g *Graph) WriteMermaid(w io.Writer) error {
+	nodes, edges, max := g.snapshot()
+
+	ids := make(map[graphNode]string, len(nodes))
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "flowchart LR")
+	for i, node := range nodes {
+		id := "n" + strconv.Itoa(i)
+		ids[node] = id
+		label := `"` + strings.ReplaceAll(node.name, `"`, "#quot;") + `"`
+		switch node.kind {
+		case inNode:
+			fmt.Fprintf(b, "\t%s([%s])\n", id, label)
+		case handlerNode:
+			fmt.Fprintf(b, "\t%s[%s]\n", id, label)
+		case outNode:
+			fmt.Fprintf(b, "\t%s[/%s/]\n", id, label)
+		}
+	}
+	for _, edge := range edges {
+		arrow := "-->"
+		if isHot(edge.count, max) {
+			arrow = "==>"
+		}
+		fmt.Fprintf(
+			b, "\t%s %s|%d| %s\n",
+			ids[edge.from], arrow, edge.count, ids[edge.to])
+	}
+	return b.Flush()
+}
+
+type countedEdge struct {
+	graphEdge
+	count int
+}
+
+// snapshot returns the nodes and edges of the graph in a fixed
+// order, and the count of the busiest edge.
+func (g *Graph) snapshot() ([]graphNode, []countedEdge, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	seen := make(map[graphNode]bool)
+	var nodes []graphNode
+	var edges []countedEdge
+	max := 0
+	for edge, count := range g.edges {
+		for _, node := range []graphNode{edge.from, edge.to} {
+			if !seen[node] {
+				seen[node] = true
+				nodes = append(nodes, node)
+			}
+		}
+		edges = append(edges, countedEdge{edge, count})
+		if count > max {
+			max = count
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].less(nodes[j])
+	})
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].from != edges[j].from {
+			return edges[i].from.less(edges[j].from)
+		}
+		return edges[i].to.less(edges[j].to)
+	})
+	return nodes, edges, max
+}
+
+func isHot(count, max int) bool {
+	return 2*count >= max
+}
+
+func (n graphNode) less(m graphNode) bool {
+	if n.kind != m.kind {
+		return n.kind < m.kind
+	}
+	return n.name < m.name
+}
+
+func (n graphNode) id() string {
+	switch n.kind {
+	case inNode:
+		return "in " + n.name
+	case handlerNode:
+		return "handler " + n.name
+	default:
+		return "out " + n.name
+	}
+}
+
+func (n graphNode) shape() string {
+	switch n.kind {
+	case inNode:
+		return "ellipse"
+	case handlerNode:
+		return "box"
+	default:
+		return "parallelogram"
+	}
+}
+
+// typeName gives the name of the dynamic type of v, including its
+// package, like "main.readFile", or "<nil>" if v is nil.
+func typeName(v interface{}) string {
+	if v == nil {
+		return "<nil>"
+	}
+	return reflect.TypeOf(v).String()
+}
@@ -0,0 +1,66 @@
+package gu
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	var g Graph
+	for i := 0; i < 3; i++ {
+		g.Observe(Transition{In: inc{}, Outputs: []Out{send{inc{}}}})
+	}
+	g.Observe(Transition{In: inc{}, Cause: send{}, Waiter: ticket{}})
+	g.Observe(Received{In: inc{}})
+
+	var mermaid bytes.Buffer
+	if err := g.WriteMermaid(&mermaid); err != nil {
+		t.Fatal(err)
+	}
+	want := `flowchart LR
+	n0(["gu.inc"])
+	n1["gu.inc.Update"]
+	n2["gu.ticket"]
+	n3[/"gu.send"/]
+	n0 ==>|3| n1
+	n0 -->|1| n2
+	n1 ==>|3| n3
+	n3 -->|1| n0
+`
+	if mermaid.String() != want {
+		t.Errorf("Mermaid is\n%s\nexpected\n%s", mermaid.String(), want)
+	}
+
+	var dot bytes.Buffer
+	if err := g.WriteDot(&dot); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`"in gu.inc" [label="gu.inc" shape=ellipse];`,
+		`"out gu.send" [label="gu.send" shape=parallelogram];`,
+		`"in gu.inc" -> "handler gu.inc.Update" [label=3 penwidth=5.0 color=red];`,
+		`"out gu.send" -> "in gu.inc" [label=1 penwidth=2.3 color=black];`,
+	} {
+		if !strings.Contains(dot.String(), line) {
+			t.Errorf("DOT doesn't have %s in\n%s", line, dot.String())
+		}
+	}
+}
+
+func TestGraphFromRun(t *testing.T) {
+	var g Graph
+	p := Start(start{
+		state:     count{limit: 2},
+		outputs:   []Out{send{inc{}}, send{inc{}}},
+		observers: []Observer{&g},
+	})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	var mermaid bytes.Buffer
+	g.WriteMermaid(&mermaid)
+	if !strings.Contains(mermaid.String(), "==>|2|") {
+		t.Errorf("Mermaid is\n%s", mermaid.String())
+	}
+}
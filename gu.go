@@ -18,10 +18,22 @@ state struct, and updating it when new IO messages come in.
 */
 package gu
 
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // State is the global state of the program. So all of the state in
 // a gu program is kept in one place.
 type State interface {
-	// Waiters gets the list of waiters from the state.
+	// Waiters gets the list of waiters from the state. Waiters
+	// can also be kept by the main loop instead, using WaitOnce
+	// and WaitAlways.
 	Waiters() []Waiter
 
 	// FatalErr is used to signal that the program has encountered
@@ -64,6 +76,13 @@ type Out interface {
 	//
 	// Try to make Io implementations as short as they can possibly
 	// be and let the pure functions do the logic.
+	//
+	// Io should not send anything down the chan after it has
+	// returned, because when the program is observed the chan is
+	// only read from while Io is running. An Io that leaves a
+	// goroutine behind to send later should call Hold before it
+	// returns, and the goroutine should release it once it has
+	// finished sending.
 	Io(chan In)
 
 	// Fast determines if the IO action should be run in its own
@@ -117,40 +136,498 @@ type Init interface {
 
 // Run is the main loop of the whole program. It initialises the
 // global state and runs any initial IO actions. It then runs until
-// it is told to crash on an unrecoverable error.
+// it is told to crash on an unrecoverable error. Before it returns
+// the error, it runs the outputs from the last update and any
+// cleanup outputs from the state, and the error also wraps any of
+// those that fail.
 //
 // On each pass of the loop it runs all the IO actions it has been
 // told to, reads in any new inputs from the outside world, and
 // updates the global state.
+//
+// Updates and IO actions are run with runtime/pprof labels giving
+// their types: gu.in for the input, gu.waiter for the Waiter that
+// claimed it and gu.out for the output. So CPU profiles can be
+// broken down by the flow of messages.
+//
+// The main loop, the updates and Fast outputs run on the goroutine
+// that called Run, so a panic in one of them can be recovered by the
+// caller. Use Start instead to run the main loop in the background.
 func Run(init Init) error {
-	state := init.InitState()
-	outputs := init.InitOutputs()
+	m, outputs := NewMachine(init)
+	l := newLoop(init)
+	l.publish(m.m.state)
+	defer close(l.done)
+	return l.run(&m.m, outputs)
+}
+
+// run is the main loop. It returns when the state has a fatal error,
+// the runtime itself fails or the program is stopped.
+func (l *loop) run(m *machine, outputs []Out) error {
+	var span SpanContext
+	l.compareInit(m, outputs)
+	l.reportInit(m)
+	restarted := l.restart(m, span)
+
+	defer func() {
+		if r := recover(); r != nil {
+			l.observe(Panicked{
+				Value: r,
+				Stack: debug.Stack(),
+				State: m.state,
+				Time:  time.Now(),
+			})
+			panic(r)
+		}
+	}()
+
+	if l.maxWaiterAge > 0 {
+		ticker := time.NewTicker(l.maxWaiterAge / 2)
+		defer ticker.Stop()
+		l.agingTick = ticker.C
+		l.age(m, time.Now())
+	}
+
+	// in is the input of the last transition, which is saved in the
+	// Outbox with its outputs.
+	var in In
+	for l.err == nil && m.state.FatalErr() == nil {
+		keys, err := l.save(in, outputs)
+		if err != nil {
+			l.err = err
+			break
+		}
+		for i, output := range outputs {
+			var key string
+			if keys != nil {
+				key = keys[i]
+			}
+			if restarted[key] {
+				// It is an initial output that was
+				// pending, and has been started by
+				// restart.
+				continue
+			}
+			l.start(output, key, span)
+		}
+		restarted = nil
+
+		msg, ok := l.receive(m)
+		for ok && l.duplicate(msg.in) {
+			msg, ok = l.receive(m)
+		}
+		if !ok {
+			break
+		}
+		start := time.Now()
+		l.observe(Received{In: msg.in, Time: start})
+		if err := l.essentialErr(); err != nil {
+			l.err = err
+			break
+		}
+
+		var waiter Waiter
+		outputs, waiter = m.update(msg.in)
+		in = msg.in
+		l.runShadow(msg.in, m, outputs)
+		if l.queryMode == ReadSnapshot {
+			l.publish(m.state)
+		}
+
+		parent := msg.span
+		if traced, ok := msg.in.(TracedIn); ok {
+			remote, err := ParseTraceparent(traced.Traceparent())
+			if err == nil {
+				parent = remote
+			}
+		}
+		span = l.newSpan(parent)
+
+		l.observe(Transition{
+			In:      msg.in,
+			Cause:   msg.cause,
+			Waiter:  waiter,
+			Outputs: outputs,
+			Span:    span,
+			Parent:  parent,
+			Start:   start,
+			End:     time.Now(),
+		})
+
+		if letter, ok := m.deadLetter(msg.in, waiter); ok {
+			l.deadLetter(letter)
+		}
+		l.report(m, msg.in, waiter)
+		l.age(m, time.Now())
+	}
+
+	l.final = m
+	l.publish(m.state)
+	err := l.err
+	if err == nil {
+		err = m.state.FatalErr()
+	}
+	if err != nil && l.err == nil {
+		// The outputs are those of the transition that set the
+		// fatal error, which haven't been started.
+		if failed := l.cleanup(m.state, outputs); failed != nil {
+			err = errors.Join(err, failed)
+		}
+	}
+	l.observe(Stopped{Err: err, State: m.state})
+	return err
+}
+
+// loop holds the channels and settings used by the main loop in Run.
+type loop struct {
+	observers []Observer
+
+	// inChan is the channel that Io functions send inputs down.
+	inChan chan In
+
+	// caused is used instead of inChan when the program is
+	// observed, so that each input can be traced back to the
+	// output that sent it.
+	caused chan message
+
+	// queries are asked by Program.Query when the query mode is
+	// AskLoop.
+	queries   chan query
+	queryMode QueryMode
+
+	// final is the machine once the main loop has ended.
+	final *machine
+
+	// snapshot holds the latest state when the query mode is
+	// ReadSnapshot, and the final state once the main loop has
+	// ended.
+	snapshot atomic.Value
+
+	// stop is closed to ask the main loop to end.
+	stop chan struct{}
+
+	// done is closed when the main loop has ended.
+	done chan struct{}
+
+	// pending are inputs made by the main loop itself, waiting to
+	// be processed.
+	pending []message
+
+	deadLetters DeadLetterHandler
+	outbox      Outbox
+	inbox       *Inbox
+	shadow      *shadow
+
+	// cleanupDeadline is how long the outputs run after a fatal
+	// error are given to finish.
+	cleanupDeadline time.Duration
+
+	// err is a failure of the runtime itself, such as saving to
+	// the Outbox, which ends the main loop.
+	err error
+
+	// ages are when each Waiter was first seen, if the maximum age
+	// of Waiters is set. agingTick is then used to check them while
+	// the main loop is idle.
+	maxWaiterAge time.Duration
+	ages         map[interface{}]*waiterAge
+	agingTick    <-chan time.Time
+}
+
+// message is an input along with the output whose Io sent it and
+// the span of that output. The cause is nil if it isn't known.
+type message struct {
+	in    In
+	cause Out
+	span  SpanContext
+}
+
+func newLoop(init Init) *loop {
+	l := &loop{
+		inChan:  make(chan In, 1),
+		caused:  make(chan message, 1),
+		queries: make(chan query),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+
+		cleanupDeadline: defaultCleanupDeadline,
+	}
+	if observed, ok := init.(Observed); ok {
+		l.observers = observed.Observers()
+	}
+	if queried, ok := init.(Queried); ok {
+		l.queryMode = queried.QueryMode()
+	}
+	if handler, ok := init.(DeadLetterHandler); ok {
+		l.deadLetters = handler
+	}
+	if shadowed, ok := init.(Shadowed); ok {
+		l.shadow = newShadow(shadowed.Shadow())
+	}
+	if deadline, ok := init.(CleanupDeadline); ok {
+		l.cleanupDeadline = deadline.CleanupDeadline()
+	}
+	if outboxed, ok := init.(Outboxed); ok {
+		l.outbox = outboxed.Outbox()
+	}
+	if deduplicated, ok := init.(Deduplicated); ok {
+		l.inbox = deduplicated.Inbox()
+	}
+	if aging, ok := init.(WaiterAging); ok && aging.MaxWaiterAge() > 0 {
+		l.maxWaiterAge = aging.MaxWaiterAge()
+		l.ages = make(map[interface{}]*waiterAge)
+	}
+	return l
+}
 
-	inChan := make(chan In, 1)
+// start runs an IO action, in its own goroutine if it isn't Fast.
+// The key is for a durable output that has been saved in the Outbox.
+// The parent is the span of the transition that returned it.
+func (l *loop) start(output Out, key string, parent SpanContext) {
+	if len(l.observers) == 0 {
+		run := func() {
+			labelled(output, func() { l.io(output, key, l.inChan, parent) })
+		}
+		if output.Fast() {
+			run()
+		} else {
+			go run()
+		}
+		return
+	}
 
-	for state.FatalErr() == nil {
-		for _, output := range outputs {
-			if output.Fast() {
-				output.Io(inChan)
-			} else {
-				go output.Io(inChan)
+	span := l.newSpan(parent)
+	ch := make(chan In, 1)
+	f := &forwarding{n: 1, idle: make(chan struct{})}
+	forwardings.Store(ch, f)
+	go l.forward(message{cause: output, span: span}, ch, f)
+
+	l.observe(OutputStarted{
+		Out:    output,
+		Span:   span,
+		Parent: parent,
+		Time:   time.Now(),
+	})
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				l.observe(Panicked{
+					Value: r,
+					Stack: debug.Stack(),
+					Out:   output,
+					Time:  time.Now(),
+				})
+				panic(r)
 			}
+		}()
+		labelled(output, func() { l.io(output, key, ch, span) })
+		f.release()
+		l.observe(OutputReturned{
+			Out:  output,
+			Span: span,
+			Time: time.Now(),
+		})
+	}
+
+	if output.Fast() {
+		run()
+	} else {
+		go run()
+	}
+}
+
+// forward passes on the inputs sent by an output's Io, labelled with
+// the output and its span, until the Io has returned and any Holds on
+// its chan have been released.
+func (l *loop) forward(cause message, ch chan In, f *forwarding) {
+	defer forwardings.Delete(ch)
+	for {
+		select {
+		case cause.in = <-ch:
+			if !l.send(cause) {
+				return
+			}
+		case <-f.idle:
+			for {
+				select {
+				case cause.in = <-ch:
+					if !l.send(cause) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-l.done:
+			return
 		}
+	}
+}
 
-		in := <-inChan
+// forwarding counts what may still send on an observed output's chan:
+// its Io until it returns, and each Hold until it is released. idle is
+// closed when there is nothing left.
+type forwarding struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+// forwardings are the chans given to observed outputs that are being
+// forwarded, so that Hold can find them.
+var forwardings sync.Map
 
-		state, outputs = update(state, in)
+func (f *forwarding) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
 	}
+}
 
-	return state.FatalErr()
+// Hold keeps the chan given to an Io open after the Io returns, for a
+// goroutine it leaves behind that sends on it later. It must be called
+// by the Io before it returns, and the release function it returns
+// must be called once nothing more will be sent. Release can be called
+// more than once.
+func Hold(ch chan In) (release func()) {
+	v, ok := forwardings.Load(ch)
+	if !ok {
+		// The program isn't observed, so the chan is always
+		// read from.
+		return func() {}
+	}
+	f := v.(*forwarding)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 {
+		return func() {}
+	}
+	f.n++
+	var once sync.Once
+	return func() { once.Do(f.release) }
 }
 
-func update(state State, in In) (State, []Out) {
-	for _, waiter := range state.Waiters() {
+func (l *loop) send(msg message) bool {
+	select {
+	case l.caused <- msg:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// receive waits for the next input from the outside world,
+// answering any queries about the state while it waits. It returns
+// false if the program is stopped first. Inputs made by the main loop
+// itself are taken first.
+func (l *loop) receive(m *machine) (message, bool) {
+	if len(l.pending) > 0 {
+		msg := l.pending[0]
+		l.pending = l.pending[1:]
+		return msg, true
+	}
+	for {
+		select {
+		case in := <-l.inChan:
+			return message{in: in}, true
+		case msg := <-l.caused:
+			return msg, true
+		case q := <-l.queries:
+			q.answer <- q.ask(m)
+		case now := <-l.agingTick:
+			l.age(m, now)
+		case <-l.stop:
+			return message{}, false
+		}
+	}
+}
+
+// newSpan makes a new span that is a child of the parent, or the
+// root of a new trace if the parent isn't valid. Spans are only made
+// when the program is observed.
+func (l *loop) newSpan(parent SpanContext) SpanContext {
+	if len(l.observers) == 0 {
+		return SpanContext{}
+	}
+	return parent.newChild()
+}
+
+func (l *loop) observe(event Event) {
+	for _, observer := range l.observers {
+		observer.Observe(event)
+	}
+}
+
+// machine is the pure part of the main loop. It is the state along
+// with the waiters that the runtime keeps for it.
+type machine struct {
+	state   State
+	waiters []keptWaiter
+	nextID  keptID
+
+	// rejected is set by Reject during an update, and reported
+	// are the errors given to Report.
+	rejected error
+	reported []error
+}
+
+// update applies a new input to the state, and returns the outputs
+// to run. The Waiter that claimed the input is also returned, or nil
+// if none of them wanted it. The waiters in the state are offered the
+// input before the ones kept by the runtime.
+//
+// The update is run with pprof labels for the types of the input and
+// the Waiter, so that CPU profiles show the cost of each of them.
+func (m *machine) update(in In) ([]Out, Waiter) {
+	var outputs []Out
+	var claimed Waiter
+	m.rejected = nil
+	m.reported = nil
+	labels := pprof.Labels("gu.in", typeName(in))
+	pprof.Do(context.Background(), labels, func(ctx context.Context) {
+		ready, waiter := m.claim(in)
+		if ready == nil {
+			m.state, outputs = in.Update(m.state)
+			return
+		}
+		claimed = waiter
+		labels := pprof.Labels("gu.waiter", typeName(waiter))
+		pprof.Do(ctx, labels, func(context.Context) {
+			m.state, outputs = ready.Update(m.state)
+		})
+	})
+	m.tidy()
+	return m.direct(outputs), claimed
+}
+
+// claim finds the first waiter that expects the input. A one-off
+// waiter is removed once it has claimed an input.
+func (m *machine) claim(in In) (Ready, Waiter) {
+	for _, waiter := range m.state.Waiters() {
 		ready, relevant := waiter.Expected(in)
 		if relevant {
-			return ready.Update(state)
+			return ready, waiter
 		}
 	}
-	return in.Update(state)
+	for i, kept := range m.waiters {
+		ready, relevant := kept.waiter.Expected(in)
+		if relevant {
+			if kept.once {
+				m.waiters = append(m.waiters[:i:i], m.waiters[i+1:]...)
+			}
+			return ready, kept.waiter
+		}
+	}
+	return nil, nil
+}
+
+// labelled runs an output's Io with a pprof label for its type. Any
+// goroutines the Io starts get the label too.
+func labelled(output Out, io func()) {
+	labels := pprof.Labels("gu.out", typeName(output))
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		io()
+	})
 }
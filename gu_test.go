@@ -0,0 +1,207 @@
+package gu
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// count is a State that counts its inputs, and stops with errDone
+// once it has seen limit of them.
+type count struct {
+	n       int
+	limit   int
+	waiters []Waiter
+}
+
+var errDone = errors.New("done")
+
+func (c count) Waiters() []Waiter { return c.waiters }
+
+func (c count) FatalErr() error {
+	if c.limit > 0 && c.n >= c.limit {
+		return errDone
+	}
+	return nil
+}
+
+// inc is an input that adds one to the count.
+type inc struct{}
+
+func (inc) Router(Waiter) Ready { return nil }
+
+func (inc) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.n++
+	return c, nil
+}
+
+// send is an output that sends its input straight away.
+type send struct{ in In }
+
+func (s send) Io(ch chan In) { ch <- s.in }
+func (send) Fast() bool      { return false }
+
+// later is a Fast output whose Io returns at once, leaving a goroutine
+// that sends an inc afterwards.
+type later struct{}
+
+func (later) Io(ch chan In) {
+	release := Hold(ch)
+	go func() {
+		defer release()
+		time.Sleep(10 * time.Millisecond)
+		ch <- inc{}
+	}()
+}
+
+func (later) Fast() bool { return true }
+
+// start is an Init with a count, some outputs and Observers.
+type start struct {
+	state     State
+	outputs   []Out
+	observers []Observer
+}
+
+func (s start) InitState() State      { return s.state }
+func (s start) InitOutputs() []Out    { return s.outputs }
+func (s start) Observers() []Observer { return s.observers }
+
+// wait returns the result of the program, failing the test if it
+// doesn't stop in time.
+func wait(t *testing.T, p *Program) error {
+	t.Helper()
+	select {
+	case <-p.Done():
+		return p.Wait()
+	case <-time.After(5 * time.Second):
+		p.Stop()
+		t.Fatal("program didn't stop")
+		return nil
+	}
+}
+
+func TestLateSend(t *testing.T) {
+	for _, observers := range [][]Observer{nil, {&Graph{}}} {
+		p := Start(start{
+			state:     count{limit: 1},
+			outputs:   []Out{later{}},
+			observers: observers,
+		})
+		if err := wait(t, p); err != errDone {
+			t.Errorf("with %d observers, got %v", len(observers), err)
+		}
+	}
+}
+
+func TestNoGoroutinePerOutput(t *testing.T) {
+	before := runtime.NumGoroutine()
+	outputs := make([]Out, 1000)
+	for i := range outputs {
+		outputs[i] = send{inc{}}
+	}
+	p := Start(start{state: count{}, outputs: outputs, observers: []Observer{&Graph{}}})
+	defer p.Stop()
+	eventually(t, p, len(outputs))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before+10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left from %d outputs", runtime.NumGoroutine()-before, len(outputs))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// crash is an input whose update panics.
+type crash struct{}
+
+func (crash) Router(Waiter) Ready { return nil }
+
+func (crash) Update(State) (State, []Out) { panic("crashed") }
+
+func TestRun(t *testing.T) {
+	if err := Run(start{state: count{limit: 1}, outputs: []Out{send{inc{}}}}); err != errDone {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRunPanic(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "crashed" {
+			t.Errorf("recovered %v", r)
+		}
+	}()
+	Run(start{state: count{}, outputs: []Out{send{crash{}}}})
+	t.Error("Run returned")
+}
+
+func TestSend(t *testing.T) {
+	p := Start(start{state: count{limit: 3}})
+	for i := 0; i < 3; i++ {
+		p.Send(inc{})
+	}
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	// Sending to a program that has ended doesn't block.
+	p.Send(inc{})
+}
+
+// recorder is an Observer that keeps the events.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Observe(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// find returns the events of type E.
+func find[E Event](r *recorder) []E {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []E
+	for _, e := range r.events {
+		if e, ok := e.(E); ok {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// ticket is a Waiter in a count for the answer with its key.
+type ticket struct{ key string }
+
+func (t ticket) Expected(in In) (Ready, bool) {
+	if a, ok := in.(answer); ok && a.key == t.key {
+		return a, true
+	}
+	return nil, false
+}
+
+func (t ticket) WaiterKey() string { return t.key }
+
+// answer is an input for a ticket, which removes it from the count.
+type answer struct{ key string }
+
+func (answer) Router(Waiter) Ready { return nil }
+
+func (a answer) Update(s State) (State, []Out) {
+	c := s.(count)
+	var waiters []Waiter
+	for _, w := range c.waiters {
+		if w != (ticket{a.key}) {
+			waiters = append(waiters, w)
+		}
+	}
+	c.waiters = waiters
+	c.n++
+	return c, nil
+}
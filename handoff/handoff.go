@@ -0,0 +1,308 @@
+//go:build unix
+
+/*
+Package handoff restarts a gu program without dropping connections,
+by handing its listening sockets and its state to a new process.
+
+The old process starts the new binary with Restart. It stops taking
+new work by closing its copies of the listeners, so that connections
+wait in the sockets' queues, and uses Drain to finish the work it had
+in progress and stop the program. Then it passes the listeners' file
+descriptors and the final state to the new process over a Unix
+socket. The new process picks them up with Resume, starts its program
+from the state and serves on the same sockets. Since the state is
+taken after the old program has stopped, no transition is lost.
+
+The state is encoded with encoding/gob, so the types in it must be
+registered with gob.Register. Only the state is passed on, and Drain
+waits for its Waiters, and those kept by WaitOnce, so that the
+responses to the old process's outputs are processed there. Waiters
+kept by WaitAlways stay with the old process, and the new program
+should start its own.
+*/
+package handoff
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+// envFD is the environment variable that tells the new process which
+// file descriptor is its end of the Unix socket.
+const envFD = "GU_HANDOFF_FD"
+
+// maxListeners is the most listeners that can be handed over.
+const maxListeners = 64
+
+// ErrDrainTimeout is returned by Drain if the Waiters didn't finish
+// in time.
+var ErrDrainTimeout = errors.New("handoff: timed out draining waiters")
+
+// Listener is a listening socket that can be handed over, such as a
+// *net.TCPListener or *net.UnixListener.
+type Listener interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+// header is sent after the file descriptors. Names are the names of
+// the listeners, in the same order.
+type header struct {
+	Names []string
+	State gu.State
+}
+
+// Restart starts the new process, which must call Resume, and hands
+// over the listeners and the program. First it closes the listeners,
+// so that new connections wait for the new process, and drains the
+// program with Drain. Then it sends the file descriptors and the final
+// state, and waits up to timeout for the new process to be Ready. So
+// the program's outputs should stop taking new work when their
+// listeners are closed.
+//
+// If it returns an error before the listeners are closed, because the
+// new process couldn't be started, then the program carries on as
+// before, so a failed restart doesn't stop the service. Otherwise the
+// program has been stopped, and the error is ErrDrainTimeout if the
+// state was handed over with some of its Waiters still waiting, or
+// says why the handover failed. The new process may still be running,
+// and cmd can be used to kill it.
+func Restart(p *gu.Program, listeners map[string]Listener, cmd *exec.Cmd, timeout time.Duration) error {
+	if len(listeners) > maxListeners {
+		return fmt.Errorf("handoff: can't hand over more than %d listeners", maxListeners)
+	}
+	var names []string
+	var fds []int
+	for name, listener := range listeners {
+		// The file is a copy of the socket, which stays open
+		// when the listener is closed.
+		file, err := listener.File()
+		if err != nil {
+			return fmt.Errorf("handoff: listener %s: %w", name, err)
+		}
+		defer file.Close()
+
+		// file.Fd would put the socket in blocking mode, which
+		// it shares with the listener, so that closing the
+		// listener would wait for its Accept to return.
+		raw, err := file.SyscallConn()
+		if err != nil {
+			return err
+		}
+		raw.Control(func(fd uintptr) { fds = append(fds, int(fd)) })
+		names = append(names, name)
+	}
+
+	conn, child, err := socketPair()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, child)
+	fd := 3 + len(cmd.ExtraFiles) - 1
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, envFD+"="+strconv.Itoa(fd))
+	err = cmd.Start()
+	child.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	drained := Drain(p, timeout)
+	state := p.Query(func(s gu.State) interface{} { return s }).(gu.State)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, _, err = conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(conn).Encode(header{Names: names, State: state})
+	if err != nil {
+		return err
+	}
+
+	var ready [1]byte
+	if _, err := conn.Read(ready[:]); err != nil {
+		return fmt.Errorf("handoff: new process didn't get ready: %w", err)
+	}
+	return drained
+}
+
+func socketPair() (*net.UnixConn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	parent := os.NewFile(uintptr(fds[0]), "handoff")
+	child := os.NewFile(uintptr(fds[1]), "handoff")
+
+	conn, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		child.Close()
+		return nil, nil, err
+	}
+	return conn.(*net.UnixConn), child, nil
+}
+
+// Drain waits for the program to have no Waiters, apart from those
+// kept by WaitAlways, which never finish, and then stops it. So the
+// responses to the outputs it started are still processed, as long as
+// it has stopped taking new work. If there are still Waiters after
+// timeout then the program is stopped anyway, and ErrDrainTimeout is
+// returned.
+func Drain(p *gu.Program, timeout time.Duration) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for waiting(p) {
+		select {
+		case <-p.Done():
+			return p.Wait()
+		case <-deadline:
+			p.Stop()
+			p.Wait()
+			return ErrDrainTimeout
+		case <-ticker.C:
+		}
+	}
+	p.Stop()
+	return p.Wait()
+}
+
+// waiting reports whether the program has any Waiters that Drain
+// waits for.
+func waiting(p *gu.Program) bool {
+	for _, info := range p.Waiters() {
+		if !info.Always {
+			return true
+		}
+	}
+	return false
+}
+
+// Handoff is what the new process was given by the old one.
+type Handoff struct {
+	conn      *net.UnixConn
+	listeners map[string]*os.File
+	state     gu.State
+}
+
+// Resume picks up what the old process handed over, which it sends
+// once it has drained its program. It returns nil and no error if the
+// process wasn't started by Restart, in which case it should start
+// from scratch.
+func Resume() (*Handoff, error) {
+	value, ok := os.LookupEnv(envFD)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(envFD)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("handoff: bad %s: %w", envFD, err)
+	}
+	file := os.NewFile(uintptr(fd), "handoff")
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	h := &Handoff{conn: conn.(*net.UnixConn)}
+	err = h.receive()
+	if err != nil {
+		h.conn.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Handoff) receive() error {
+	var first [1]byte
+	oob := make([]byte, syscall.CmsgSpace(4*maxListeners))
+	_, oobn, _, _, err := h.conn.ReadMsgUnix(first[:], oob)
+	if err != nil {
+		return err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	var fds []int
+	for _, message := range messages {
+		rights, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			return err
+		}
+		fds = append(fds, rights...)
+	}
+
+	var header header
+	err = gob.NewDecoder(h.conn).Decode(&header)
+	if err != nil {
+		return err
+	}
+	if len(header.Names) != len(fds) {
+		return fmt.Errorf("handoff: got %d listeners, expected %d", len(fds), len(header.Names))
+	}
+	h.listeners = make(map[string]*os.File, len(fds))
+	for i, name := range header.Names {
+		h.listeners[name] = os.NewFile(uintptr(fds[i]), name)
+	}
+	h.state = header.State
+	return nil
+}
+
+// Listener returns the listener the old process handed over with the
+// name, or an error if there wasn't one.
+func (h *Handoff) Listener(name string) (net.Listener, error) {
+	file, ok := h.listeners[name]
+	if !ok {
+		return nil, fmt.Errorf("handoff: no listener called %s", name)
+	}
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	delete(h.listeners, name)
+	return listener, nil
+}
+
+// State returns the state of the old program, for the InitState of
+// the new one.
+func (h *Handoff) State() gu.State {
+	return h.state
+}
+
+// Ready tells the old process that the new one is serving, so that
+// Restart can return. Listeners that were handed over but
+// not taken with Listener are closed.
+func (h *Handoff) Ready() error {
+	for name, file := range h.listeners {
+		file.Close()
+		delete(h.listeners, name)
+	}
+	_, err := h.conn.Write([]byte{1})
+	if closeErr := h.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
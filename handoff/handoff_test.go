@@ -0,0 +1,176 @@
+//go:build unix
+
+package handoff
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+type State struct {
+	N       int
+	waiters []gu.Waiter
+}
+
+func (s State) Waiters() []gu.Waiter { return s.waiters }
+func (State) FatalErr() error        { return nil }
+
+type start struct {
+	state   gu.State
+	outputs []gu.Out
+}
+
+func (s start) InitState() gu.State   { return s.state }
+func (s start) InitOutputs() []gu.Out { return s.outputs }
+
+// reply is an input for the waitFor with the same name, which counts
+// it and removes it from the state.
+type reply string
+
+func (reply) Router(gu.Waiter) gu.Ready { return nil }
+
+func (r reply) Update(s gu.State) (gu.State, []gu.Out) {
+	state := s.(State)
+	state.N++
+	var waiters []gu.Waiter
+	for _, w := range state.waiters {
+		if w != waitFor(r) {
+			waiters = append(waiters, w)
+		}
+	}
+	state.waiters = waiters
+	return state, nil
+}
+
+type waitFor string
+
+func (w waitFor) Expected(in gu.In) (gu.Ready, bool) {
+	r, ok := in.(reply)
+	return r, ok && r == reply(w)
+}
+
+func init() {
+	gob.Register(State{})
+}
+
+// TestChild is the new process started by TestRestart.
+func TestChild(t *testing.T) {
+	if os.Getenv(envFD) == "" {
+		t.Skip("only run by TestRestart")
+	}
+	h, err := Resume()
+	if err != nil || h == nil {
+		t.Fatalf("got %v, %v", h, err)
+	}
+	listener, err := h.Listener("http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	n := h.State().(State).N
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "new %d", n)
+		close(served)
+	}))
+	if err := h.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	<-served
+}
+
+func TestRestart(t *testing.T) {
+	p := gu.Start(start{state: State{N: 42, waiters: []gu.Waiter{waitFor("state")}}})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "old")
+	}))
+
+	// The reply arrives while the program is draining, so the new
+	// process is given the state after it.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.Send(reply("state"))
+	}()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestChild$")
+	cmd.Stderr = os.Stderr
+	err = Restart(p, map[string]Listener{"http": listener.(*net.TCPListener)}, cmd, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	select {
+	case <-p.Done():
+	default:
+		t.Error("Restart didn't stop the program")
+	}
+
+	resp, err := http.Get("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "new 43" {
+		t.Errorf("got %q from the new process", body)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("new process failed: %v", err)
+	}
+}
+
+func TestResumeWithoutRestart(t *testing.T) {
+	if h, err := Resume(); h != nil || err != nil {
+		t.Errorf("got %v, %v", h, err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	p := gu.Start(start{
+		state: State{waiters: []gu.Waiter{waitFor("state")}},
+		outputs: []gu.Out{
+			gu.WaitAlways("always", waitFor("always")),
+			gu.WaitOnce(waitFor("once")),
+		},
+	})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.Send(reply("once"))
+		time.Sleep(20 * time.Millisecond)
+		p.Send(reply("state"))
+	}()
+
+	begin := time.Now()
+	if err := Drain(p, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(begin); waited < 40*time.Millisecond || waited > time.Second {
+		t.Errorf("Drain waited for %s", waited)
+	}
+	select {
+	case <-p.Done():
+	default:
+		t.Error("Drain didn't stop the program")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	p := gu.Start(start{
+		state:   State{waiters: []gu.Waiter{waitFor("state")}},
+		outputs: []gu.Out{gu.WaitAlways("always", waitFor("always"))},
+	})
+	if err := Drain(p, 20*time.Millisecond); err != ErrDrainTimeout {
+		t.Errorf("got %v", err)
+	}
+}
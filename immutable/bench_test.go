@@ -0,0 +1,101 @@
+package immutable
+
+import (
+	"fmt"
+	"testing"
+)
+
+// The benchmarks compare the collections with built-in maps and
+// slices that are copied on each update, as a pure update would
+// otherwise have to do.
+
+var sizes = []int{100, 10000, 100000}
+
+func BenchmarkMapSet(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("copy/%d", size), func(b *testing.B) {
+			m := make(map[int]int, size)
+			for i := 0; i < size; i++ {
+				m[i] = i
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				next := make(map[int]int, len(m))
+				for k, v := range m {
+					next[k] = v
+				}
+				next[i%size] = i
+				m = next
+			}
+		})
+		b.Run(fmt.Sprintf("Map/%d", size), func(b *testing.B) {
+			var m Map[int, int]
+			for i := 0; i < size; i++ {
+				m = m.Set(i, i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m = m.Set(i%size, i)
+			}
+		})
+		b.Run(fmt.Sprintf("SortedMap/%d", size), func(b *testing.B) {
+			var m SortedMap[int, int]
+			for i := 0; i < size; i++ {
+				m = m.Set(i, i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m = m.Set(i%size, i)
+			}
+		})
+	}
+}
+
+func BenchmarkMapGet(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("builtin/%d", size), func(b *testing.B) {
+			m := make(map[int]int, size)
+			for i := 0; i < size; i++ {
+				m[i] = i
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = m[i%size]
+			}
+		})
+		b.Run(fmt.Sprintf("Map/%d", size), func(b *testing.B) {
+			var m Map[int, int]
+			for i := 0; i < size; i++ {
+				m = m.Set(i, i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Get(i % size)
+			}
+		})
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(fmt.Sprintf("copy/%d", size), func(b *testing.B) {
+			s := make([]int, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				next := make([]int, len(s), len(s)+1)
+				copy(next, s)
+				s = append(next, i)[1:]
+			}
+		})
+		b.Run(fmt.Sprintf("Vector/%d", size), func(b *testing.B) {
+			var v Vector[int]
+			for i := 0; i < size; i++ {
+				v = v.Append(i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				v = v.Append(i)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package immutable
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+// Map is a persistent hash map, stored as a hash array mapped trie.
+// Setting or deleting a key copies only the path to it, which is at
+// most a few small nodes.
+//
+// The order that Range visits the keys in is not fixed, and changes
+// between runs of the program, just like a built-in map.
+type Map[K comparable, V any] struct {
+	root *hamtNode[K, V]
+	size int
+}
+
+const (
+	hamtBits  = 5
+	hamtMask  = 1<<hamtBits - 1
+	hashWidth = 64
+)
+
+var seed = maphash.MakeSeed()
+
+// hamtNode holds an entry for each bit set in its bitmap, in order.
+// Once the hash has been used up, at the bottom of the trie, it is a
+// collision node that has no bitmap and holds keys with the same
+// hash in a list.
+type hamtNode[K comparable, V any] struct {
+	bitmap  uint32
+	entries []hamtEntry[K, V]
+}
+
+// hamtEntry is either a key and value, or a child node.
+type hamtEntry[K comparable, V any] struct {
+	hash  uint64
+	key   K
+	value V
+	child *hamtNode[K, V]
+}
+
+// Len returns the number of keys in the map.
+func (m Map[K, V]) Len() int {
+	return m.size
+}
+
+// Get returns the value for a key, and whether it was there.
+func (m Map[K, V]) Get(key K) (V, bool) {
+	if m.root == nil {
+		var zero V
+		return zero, false
+	}
+	return m.root.get(maphash.Comparable(seed, key), 0, key)
+}
+
+// Set returns a new map with the key set to the value.
+func (m Map[K, V]) Set(key K, value V) Map[K, V] {
+	leaf := hamtEntry[K, V]{
+		hash:  maphash.Comparable(seed, key),
+		key:   key,
+		value: value,
+	}
+	root := m.root
+	if root == nil {
+		root = &hamtNode[K, V]{}
+	}
+	root, added := root.set(leaf, 0)
+	if added {
+		return Map[K, V]{root: root, size: m.size + 1}
+	}
+	return Map[K, V]{root: root, size: m.size}
+}
+
+// Delete returns a new map without the key.
+func (m Map[K, V]) Delete(key K) Map[K, V] {
+	if m.root == nil {
+		return m
+	}
+	root, removed := m.root.delete(maphash.Comparable(seed, key), 0, key)
+	if !removed {
+		return m
+	}
+	return Map[K, V]{root: root, size: m.size - 1}
+}
+
+// Range calls f for each key and value in the map, until f returns
+// false.
+func (m Map[K, V]) Range(f func(K, V) bool) {
+	if m.root != nil {
+		m.root.each(f)
+	}
+}
+
+func (n *hamtNode[K, V]) get(hash uint64, shift uint, key K) (V, bool) {
+	var zero V
+	if shift >= hashWidth {
+		for _, e := range n.entries {
+			if e.key == key {
+				return e.value, true
+			}
+		}
+		return zero, false
+	}
+
+	bit := uint32(1) << (hash >> shift & hamtMask)
+	if n.bitmap&bit == 0 {
+		return zero, false
+	}
+	e := n.entries[n.index(bit)]
+	if e.child != nil {
+		return e.child.get(hash, shift+hamtBits, key)
+	}
+	if e.key == key {
+		return e.value, true
+	}
+	return zero, false
+}
+
+// set returns a copy of the node with the leaf in it, and whether
+// the leaf's key is new.
+func (n *hamtNode[K, V]) set(leaf hamtEntry[K, V], shift uint) (*hamtNode[K, V], bool) {
+	if shift >= hashWidth {
+		for i, e := range n.entries {
+			if e.key == leaf.key {
+				return n.replace(i, leaf), false
+			}
+		}
+		entries := make([]hamtEntry[K, V], len(n.entries), len(n.entries)+1)
+		copy(entries, n.entries)
+		return &hamtNode[K, V]{entries: append(entries, leaf)}, true
+	}
+
+	bit := uint32(1) << (leaf.hash >> shift & hamtMask)
+	i := n.index(bit)
+	if n.bitmap&bit == 0 {
+		entries := make([]hamtEntry[K, V], len(n.entries)+1)
+		copy(entries, n.entries[:i])
+		entries[i] = leaf
+		copy(entries[i+1:], n.entries[i:])
+		return &hamtNode[K, V]{bitmap: n.bitmap | bit, entries: entries}, true
+	}
+
+	e := n.entries[i]
+	switch {
+	case e.child != nil:
+		child, added := e.child.set(leaf, shift+hamtBits)
+		return n.replace(i, hamtEntry[K, V]{child: child}), added
+	case e.key == leaf.key:
+		return n.replace(i, leaf), false
+	default:
+		child := newPair(e, leaf, shift+hamtBits)
+		return n.replace(i, hamtEntry[K, V]{child: child}), true
+	}
+}
+
+// newPair makes a node holding two leaves with different keys.
+func newPair[K comparable, V any](a, b hamtEntry[K, V], shift uint) *hamtNode[K, V] {
+	if shift >= hashWidth {
+		return &hamtNode[K, V]{entries: []hamtEntry[K, V]{a, b}}
+	}
+
+	ia := a.hash >> shift & hamtMask
+	ib := b.hash >> shift & hamtMask
+	if ia == ib {
+		child := newPair(a, b, shift+hamtBits)
+		return &hamtNode[K, V]{
+			bitmap:  1 << ia,
+			entries: []hamtEntry[K, V]{{child: child}},
+		}
+	}
+	if ib < ia {
+		a, b = b, a
+	}
+	return &hamtNode[K, V]{
+		bitmap:  1<<ia | 1<<ib,
+		entries: []hamtEntry[K, V]{a, b},
+	}
+}
+
+// delete returns a copy of the node without the key, or nil if that
+// leaves it empty, and whether the key was there.
+func (n *hamtNode[K, V]) delete(hash uint64, shift uint, key K) (*hamtNode[K, V], bool) {
+	if shift >= hashWidth {
+		for i, e := range n.entries {
+			if e.key == key {
+				return n.remove(i, 0), true
+			}
+		}
+		return n, false
+	}
+
+	bit := uint32(1) << (hash >> shift & hamtMask)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	i := n.index(bit)
+	e := n.entries[i]
+	if e.child == nil {
+		if e.key != key {
+			return n, false
+		}
+		return n.remove(i, bit), true
+	}
+
+	child, removed := e.child.delete(hash, shift+hamtBits, key)
+	switch {
+	case !removed:
+		return n, false
+	case child == nil:
+		return n.remove(i, bit), true
+	case len(child.entries) == 1 && child.entries[0].child == nil:
+		// Pull a lone leaf up, so the trie stays shallow.
+		return n.replace(i, child.entries[0]), true
+	default:
+		return n.replace(i, hamtEntry[K, V]{child: child}), true
+	}
+}
+
+func (n *hamtNode[K, V]) each(f func(K, V) bool) bool {
+	for _, e := range n.entries {
+		if e.child != nil {
+			if !e.child.each(f) {
+				return false
+			}
+		} else if !f(e.key, e.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// index returns the position in the entries of the entry for a bit.
+func (n *hamtNode[K, V]) index(bit uint32) int {
+	return bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *hamtNode[K, V]) replace(i int, e hamtEntry[K, V]) *hamtNode[K, V] {
+	entries := make([]hamtEntry[K, V], len(n.entries))
+	copy(entries, n.entries)
+	entries[i] = e
+	return &hamtNode[K, V]{bitmap: n.bitmap, entries: entries}
+}
+
+// remove returns a copy of the node without entry i, which is for
+// the bit, or nil if that leaves it empty.
+func (n *hamtNode[K, V]) remove(i int, bit uint32) *hamtNode[K, V] {
+	if len(n.entries) == 1 {
+		return nil
+	}
+	entries := make([]hamtEntry[K, V], len(n.entries)-1)
+	copy(entries, n.entries[:i])
+	copy(entries[i:], n.entries[i+1:])
+	return &hamtNode[K, V]{bitmap: n.bitmap &^ bit, entries: entries}
+}
@@ -0,0 +1,84 @@
+package immutable
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestMapMatchesBuiltIn(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var m Map[int, int]
+	var s SortedMap[int, int]
+	want := map[int]int{}
+	var old Map[int, int]
+	var oldWant map[int]int
+	for i := 0; i < 100000; i++ {
+		k := r.Intn(5000)
+		if r.Intn(3) == 0 {
+			m = m.Delete(k)
+			s = s.Delete(k)
+			delete(want, k)
+		} else {
+			m = m.Set(k, i)
+			s = s.Set(k, i)
+			want[k] = i
+		}
+		if i == 1000 {
+			old = m
+			oldWant = make(map[int]int, len(want))
+			for k, v := range want {
+				oldWant[k] = v
+			}
+		}
+	}
+
+	checkMap(t, m, want)
+	checkMap(t, old, oldWant)
+	if s.Len() != len(want) {
+		t.Fatalf("sorted map has %d keys, expected %d", s.Len(), len(want))
+	}
+	for k, v := range want {
+		if got, ok := s.Get(k); !ok || got != v {
+			t.Fatalf("sorted map has %d: %d, %t, expected %d", k, got, ok, v)
+		}
+	}
+}
+
+func checkMap(t *testing.T, m Map[int, int], want map[int]int) {
+	t.Helper()
+	if m.Len() != len(want) {
+		t.Fatalf("map has %d keys, expected %d", m.Len(), len(want))
+	}
+	for k, v := range want {
+		if got, ok := m.Get(k); !ok || got != v {
+			t.Fatalf("map has %d: %d, %t, expected %d", k, got, ok, v)
+		}
+	}
+	count := 0
+	m.Range(func(k, v int) bool {
+		if want[k] != v {
+			t.Fatalf("Range gave %d: %d, expected %d", k, v, want[k])
+		}
+		count++
+		return true
+	})
+	if count != len(want) {
+		t.Fatalf("Range gave %d keys, expected %d", count, len(want))
+	}
+}
+
+func TestMapHashCollision(t *testing.T) {
+	a := hamtEntry[int, int]{hash: 7, key: 1, value: 10}
+	b := hamtEntry[int, int]{hash: 7, key: 2, value: 20}
+	n := newPair(a, b, 0)
+	if v, ok := n.get(7, 0, 2); !ok || v != 20 {
+		t.Fatalf("got %d, %t, expected 20", v, ok)
+	}
+	n, _ = n.delete(7, 0, 1)
+	if _, ok := n.get(7, 0, 1); ok {
+		t.Fatal("deleted key is still there")
+	}
+	if v, ok := n.get(7, 0, 2); !ok || v != 20 {
+		t.Fatalf("got %d, %t, expected 20", v, ok)
+	}
+}
@@ -0,0 +1,224 @@
+package immutable
+
+import (
+	"cmp"
+)
+
+// SortedMap is a persistent map that keeps its keys in order. It is
+// stored as an AVL tree, so setting or deleting a key copies the
+// nodes on the path to it, which is about log2(n) of them.
+type SortedMap[K cmp.Ordered, V any] struct {
+	root *avlNode[K, V]
+	size int
+}
+
+type avlNode[K cmp.Ordered, V any] struct {
+	key    K
+	value  V
+	left   *avlNode[K, V]
+	right  *avlNode[K, V]
+	height int
+}
+
+// Len returns the number of keys in the map.
+func (m SortedMap[K, V]) Len() int {
+	return m.size
+}
+
+// Get returns the value for a key, and whether it was there.
+func (m SortedMap[K, V]) Get(key K) (V, bool) {
+	n := m.root
+	for n != nil {
+		switch cmp.Compare(key, n.key) {
+		case -1:
+			n = n.left
+		case 1:
+			n = n.right
+		default:
+			return n.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Set returns a new map with the key set to the value.
+func (m SortedMap[K, V]) Set(key K, value V) SortedMap[K, V] {
+	root, added := m.root.set(key, value)
+	if added {
+		return SortedMap[K, V]{root: root, size: m.size + 1}
+	}
+	return SortedMap[K, V]{root: root, size: m.size}
+}
+
+// Delete returns a new map without the key.
+func (m SortedMap[K, V]) Delete(key K) SortedMap[K, V] {
+	root, removed := m.root.delete(key)
+	if !removed {
+		return m
+	}
+	return SortedMap[K, V]{root: root, size: m.size - 1}
+}
+
+// Min returns the smallest key and its value. It returns false if
+// the map is empty.
+func (m SortedMap[K, V]) Min() (K, V, bool) {
+	n := m.root
+	if n == nil {
+		var key K
+		var value V
+		return key, value, false
+	}
+	for n.left != nil {
+		n = n.left
+	}
+	return n.key, n.value, true
+}
+
+// Max returns the largest key and its value. It returns false if the
+// map is empty.
+func (m SortedMap[K, V]) Max() (K, V, bool) {
+	n := m.root
+	if n == nil {
+		var key K
+		var value V
+		return key, value, false
+	}
+	for n.right != nil {
+		n = n.right
+	}
+	return n.key, n.value, true
+}
+
+// Range calls f for each key and value in the map in order of the
+// keys, until f returns false.
+func (m SortedMap[K, V]) Range(f func(K, V) bool) {
+	m.root.each(f)
+}
+
+// RangeFrom is like Range, but starts at the first key that is not
+// less than from.
+func (m SortedMap[K, V]) RangeFrom(from K, f func(K, V) bool) {
+	m.root.eachFrom(from, f)
+}
+
+func (n *avlNode[K, V]) set(key K, value V) (*avlNode[K, V], bool) {
+	if n == nil {
+		return &avlNode[K, V]{key: key, value: value, height: 1}, true
+	}
+
+	c := *n
+	var added bool
+	switch cmp.Compare(key, n.key) {
+	case -1:
+		c.left, added = n.left.set(key, value)
+	case 1:
+		c.right, added = n.right.set(key, value)
+	default:
+		c.value = value
+		return &c, false
+	}
+	return c.balance(), added
+}
+
+func (n *avlNode[K, V]) delete(key K) (*avlNode[K, V], bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	c := *n
+	var removed bool
+	switch cmp.Compare(key, n.key) {
+	case -1:
+		c.left, removed = n.left.delete(key)
+	case 1:
+		c.right, removed = n.right.delete(key)
+	default:
+		if n.left == nil {
+			return n.right, true
+		}
+		if n.right == nil {
+			return n.left, true
+		}
+		// Replace the node with the smallest one on its right.
+		next := n.right
+		for next.left != nil {
+			next = next.left
+		}
+		c.key, c.value = next.key, next.value
+		c.right, _ = n.right.delete(next.key)
+		removed = true
+	}
+	if !removed {
+		return n, false
+	}
+	return c.balance(), true
+}
+
+// balance fixes the height of a new node, and rotates it if its
+// sides differ in height by more than one. The node must not be
+// shared yet, since it is changed.
+func (n *avlNode[K, V]) balance() *avlNode[K, V] {
+	n.fixHeight()
+	switch n.left.getHeight() - n.right.getHeight() {
+	case 2:
+		if n.left.left.getHeight() < n.left.right.getHeight() {
+			n.left = n.left.rotateLeft()
+		}
+		return n.rotateRight()
+	case -2:
+		if n.right.right.getHeight() < n.right.left.getHeight() {
+			n.right = n.right.rotateRight()
+		}
+		return n.rotateLeft()
+	}
+	return n
+}
+
+func (n *avlNode[K, V]) rotateLeft() *avlNode[K, V] {
+	top := *n.right
+	bottom := *n
+	bottom.right = top.left
+	bottom.fixHeight()
+	top.left = &bottom
+	top.fixHeight()
+	return &top
+}
+
+func (n *avlNode[K, V]) rotateRight() *avlNode[K, V] {
+	top := *n.left
+	bottom := *n
+	bottom.left = top.right
+	bottom.fixHeight()
+	top.right = &bottom
+	top.fixHeight()
+	return &top
+}
+
+func (n *avlNode[K, V]) fixHeight() {
+	n.height = 1 + max(n.left.getHeight(), n.right.getHeight())
+}
+
+func (n *avlNode[K, V]) getHeight() int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *avlNode[K, V]) each(f func(K, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	return n.left.each(f) && f(n.key, n.value) && n.right.each(f)
+}
+
+func (n *avlNode[K, V]) eachFrom(from K, f func(K, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.key < from {
+		return n.right.eachFrom(from, f)
+	}
+	return n.left.eachFrom(from, f) && f(n.key, n.value) && n.right.each(f)
+}
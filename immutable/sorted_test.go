@@ -0,0 +1,53 @@
+package immutable
+
+import (
+	"testing"
+)
+
+func TestSortedMapOrder(t *testing.T) {
+	var m SortedMap[int, string]
+	for _, k := range []int{5, 1, 9, 3, 7} {
+		m = m.Set(k, "")
+	}
+
+	var keys []int
+	m.Range(func(k int, _ string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if !equal(keys, []int{1, 3, 5, 7, 9}) {
+		t.Errorf("Range gave %v", keys)
+	}
+
+	keys = nil
+	m.RangeFrom(4, func(k int, _ string) bool {
+		keys = append(keys, k)
+		return k < 7
+	})
+	if !equal(keys, []int{5, 7}) {
+		t.Errorf("RangeFrom gave %v", keys)
+	}
+
+	if k, _, ok := m.Min(); !ok || k != 1 {
+		t.Errorf("Min is %d, %t", k, ok)
+	}
+	if k, _, ok := m.Max(); !ok || k != 9 {
+		t.Errorf("Max is %d, %t", k, ok)
+	}
+	var empty SortedMap[int, string]
+	if _, _, ok := empty.Min(); ok {
+		t.Error("empty map has a Min")
+	}
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package immutable
+
+// Vector is a persistent list, like a slice that is never changed.
+// It is stored as a tree with 32 items in each node, and the last few
+// items in a separate tail, so appending is usually cheap and getting
+// or setting an item copies at most a handful of nodes.
+type Vector[T any] struct {
+	size int
+
+	// shift is the number of bits of an index used below the root.
+	shift uint
+	root  *vectorNode[T]
+	tail  []T
+}
+
+const (
+	vectorBits  = 5
+	vectorWidth = 1 << vectorBits
+	vectorMask  = vectorWidth - 1
+)
+
+// vectorNode is a branch, which has children, or a leaf, which has
+// items.
+type vectorNode[T any] struct {
+	children []*vectorNode[T]
+	items    []T
+}
+
+// Len returns the number of items in the vector.
+func (v Vector[T]) Len() int {
+	return v.size
+}
+
+// Get returns the item at index i. It panics if i is out of range.
+func (v Vector[T]) Get(i int) T {
+	v.check(i)
+	if i >= v.tailOffset() {
+		return v.tail[i-v.tailOffset()]
+	}
+	n := v.root
+	for level := v.shift; level > 0; level -= vectorBits {
+		n = n.children[i>>level&vectorMask]
+	}
+	return n.items[i&vectorMask]
+}
+
+// Set returns a new vector with the item at index i replaced. It
+// panics if i is out of range.
+func (v Vector[T]) Set(i int, item T) Vector[T] {
+	v.check(i)
+	if i >= v.tailOffset() {
+		tail := make([]T, len(v.tail))
+		copy(tail, v.tail)
+		tail[i-v.tailOffset()] = item
+		v.tail = tail
+		return v
+	}
+	v.root = v.root.set(v.shift, i, item)
+	return v
+}
+
+// Append returns a new vector with the item added to the end.
+func (v Vector[T]) Append(item T) Vector[T] {
+	if len(v.tail) < vectorWidth {
+		tail := make([]T, len(v.tail), len(v.tail)+1)
+		copy(tail, v.tail)
+		v.tail = append(tail, item)
+		v.size++
+		return v
+	}
+
+	// The tail is full, so move it into the tree.
+	leaf := &vectorNode[T]{items: v.tail}
+	switch {
+	case v.root == nil:
+		v.root = &vectorNode[T]{children: []*vectorNode[T]{leaf}}
+		v.shift = vectorBits
+	case v.size>>vectorBits > 1<<v.shift:
+		// The tree is full, so it needs a new root.
+		v.root = &vectorNode[T]{children: []*vectorNode[T]{
+			v.root,
+			newPath(v.shift, leaf),
+		}}
+		v.shift += vectorBits
+	default:
+		v.root = v.root.push(v.shift, v.size-1, leaf)
+	}
+	v.tail = []T{item}
+	v.size++
+	return v
+}
+
+// Range calls f for each index and item in the vector in order, until
+// f returns false.
+func (v Vector[T]) Range(f func(int, T) bool) {
+	i := 0
+	var leaves func(n *vectorNode[T], level uint) bool
+	leaves = func(n *vectorNode[T], level uint) bool {
+		if level == 0 {
+			for _, item := range n.items {
+				if !f(i, item) {
+					return false
+				}
+				i++
+			}
+			return true
+		}
+		for _, child := range n.children {
+			if !leaves(child, level-vectorBits) {
+				return false
+			}
+		}
+		return true
+	}
+	if v.root != nil && !leaves(v.root, v.shift) {
+		return
+	}
+	for _, item := range v.tail {
+		if !f(i, item) {
+			return
+		}
+		i++
+	}
+}
+
+func (v Vector[T]) check(i int) {
+	if i < 0 || i >= v.size {
+		panic("immutable: index out of range")
+	}
+}
+
+// tailOffset is the index of the first item in the tail.
+func (v Vector[T]) tailOffset() int {
+	return v.size - len(v.tail)
+}
+
+func (n *vectorNode[T]) set(level uint, i int, item T) *vectorNode[T] {
+	if level == 0 {
+		items := make([]T, len(n.items))
+		copy(items, n.items)
+		items[i&vectorMask] = item
+		return &vectorNode[T]{items: items}
+	}
+
+	children := make([]*vectorNode[T], len(n.children))
+	copy(children, n.children)
+	j := i >> level & vectorMask
+	children[j] = children[j].set(level-vectorBits, i, item)
+	return &vectorNode[T]{children: children}
+}
+
+// push returns a copy of the branch with a full leaf added after
+// index last.
+func (n *vectorNode[T]) push(level uint, last int, leaf *vectorNode[T]) *vectorNode[T] {
+	j := last >> level & vectorMask
+	children := make([]*vectorNode[T], len(n.children), j+1)
+	copy(children, n.children)
+
+	var child *vectorNode[T]
+	switch {
+	case level == vectorBits:
+		child = leaf
+	case j < len(n.children):
+		child = n.children[j].push(level-vectorBits, last, leaf)
+	default:
+		child = newPath(level-vectorBits, leaf)
+	}
+
+	if j < len(children) {
+		children[j] = child
+	} else {
+		children = append(children, child)
+	}
+	return &vectorNode[T]{children: children}
+}
+
+// newPath makes a chain of branches down to the leaf.
+func newPath[T any](level uint, leaf *vectorNode[T]) *vectorNode[T] {
+	if level == 0 {
+		return leaf
+	}
+	return &vectorNode[T]{
+		children: []*vectorNode[T]{newPath(level-vectorBits, leaf)},
+	}
+}
@@ -0,0 +1,42 @@
+package immutable
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestVectorMatchesSlice(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var v, old Vector[int]
+	var want []int
+	for i := 0; i < 40000; i++ {
+		v = v.Append(i)
+		want = append(want, i)
+		if i == 5000 {
+			old = v
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		j := r.Intn(len(want))
+		v = v.Set(j, -i)
+		want[j] = -i
+	}
+
+	if v.Len() != len(want) {
+		t.Fatalf("vector has %d items, expected %d", v.Len(), len(want))
+	}
+	v.Range(func(i, item int) bool {
+		if item != want[i] || v.Get(i) != want[i] {
+			t.Fatalf("item %d is %d, expected %d", i, item, want[i])
+		}
+		return true
+	})
+	if old.Len() != 5001 {
+		t.Fatalf("old vector has %d items, expected 5001", old.Len())
+	}
+	for i := 0; i < old.Len(); i++ {
+		if old.Get(i) != i {
+			t.Fatalf("old vector changed at %d", i)
+		}
+	}
+}
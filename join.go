@@ -0,0 +1,171 @@
+package gu
+
+import (
+	"errors"
+)
+
+// Expect decides whether an input is one of the ones a combinator is
+// waiting for. If it is, err is nil if the input means success, or
+// says what went wrong, for example a failed HTTP request.
+type Expect func(In) (expected bool, err error)
+
+// Result is an input collected by a combinator. In is nil if it
+// hasn't arrived.
+type Result struct {
+	In  In
+	Err error
+}
+
+// Results are the inputs collected by a combinator, in the same order
+// as its Expects.
+type Results []Result
+
+// Then is run when a combinator has finished. ok reports whether its
+// condition was met. If it wasn't, the Results say which inputs
+// failed and which never arrived.
+type Then func(state State, results Results, ok bool) (State, []Out)
+
+// Join is a Waiter for a set of inputs, made by All, Any, Race or
+// Quorum. It collects the inputs it is waiting for and runs its Then
+// function once, when it has enough of them to decide the outcome.
+// It should be kept in the state and returned by State.Waiters until
+// it is Done, or given to WaitAlways, which removes it once it is
+// Done.
+//
+// Like a Flow, a Join is changed when its Ready is updated, so each
+// Ready it makes must only be updated once, and a state that is kept
+// after it has been updated needs a Copy of the Join.
+type Join struct {
+	expects []Expect
+	results Results
+	// need is the number of successes needed.
+	need int
+	race bool
+	then Then
+	done bool
+}
+
+// All waits for all of the inputs. It fails as soon as one of them
+// fails.
+func All(then Then, expects ...Expect) *Join {
+	return newJoin(len(expects), false, then, expects)
+}
+
+// Any waits for one of the inputs to succeed. It only fails if all
+// of them fail.
+func Any(then Then, expects ...Expect) *Join {
+	return newJoin(1, false, then, expects)
+}
+
+// Race waits for the first of the inputs, and succeeds or fails with
+// it.
+func Race(then Then, expects ...Expect) *Join {
+	return newJoin(1, true, then, expects)
+}
+
+// Quorum waits for k of the inputs to succeed. It fails as soon as
+// so many have failed that k successes are no longer possible.
+func Quorum(k int, then Then, expects ...Expect) *Join {
+	return newJoin(k, false, then, expects)
+}
+
+func newJoin(need int, race bool, then Then, expects []Expect) *Join {
+	return &Join{
+		expects: expects,
+		results: make(Results, len(expects)),
+		need:    need,
+		race:    race,
+		then:    then,
+	}
+}
+
+// Expected decides if the input is one the Join is still waiting
+// for.
+func (j *Join) Expected(in In) (Ready, bool) {
+	if j.done {
+		return nil, false
+	}
+	for i, expect := range j.expects {
+		if j.results[i].In != nil {
+			continue
+		}
+		if expected, err := expect(in); expected {
+			return joinReady{join: j, i: i, result: Result{In: in, Err: err}}, true
+		}
+	}
+	return nil, false
+}
+
+// Done reports whether the Join has finished, so it can be removed
+// from the state.
+func (j *Join) Done() bool {
+	return j.done
+}
+
+// Copy returns a copy of the Join, which collects its inputs
+// separately.
+func (j *Join) Copy() *Join {
+	c := *j
+	c.results = append(Results(nil), j.results...)
+	return &c
+}
+
+// Succeeded returns the number of inputs that have arrived and
+// succeeded.
+func (r Results) Succeeded() int {
+	n := 0
+	for _, result := range r {
+		if result.In != nil && result.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the number of inputs that have arrived and failed.
+func (r Results) Failed() int {
+	n := 0
+	for _, result := range r {
+		if result.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Err joins the errors of the inputs that failed, or returns nil if
+// none did.
+func (r Results) Err() error {
+	var errs []error
+	for _, result := range r {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type joinReady struct {
+	join   *Join
+	i      int
+	result Result
+}
+
+func (r joinReady) Update(state State) (State, []Out) {
+	j := r.join
+	j.results[r.i] = r.result
+
+	var ok bool
+	switch {
+	case j.race:
+		ok = r.result.Err == nil
+	case j.results.Succeeded() >= j.need:
+		ok = true
+	case j.results.Failed() > len(j.expects)-j.need:
+		ok = false
+	default:
+		return state, nil
+	}
+	j.done = true
+	return j.then(state, j.results, ok)
+}
@@ -0,0 +1,86 @@
+package gu
+
+import (
+	"errors"
+	"testing"
+)
+
+var errFailed = errors.New("failed")
+
+// reply expects w, which succeeds, or w+"!", which fails.
+func reply(w word) Expect {
+	return func(in In) (bool, error) {
+		switch in {
+		case w:
+			return true, nil
+		case w + "!":
+			return true, errFailed
+		}
+		return false, nil
+	}
+}
+
+func TestJoin(t *testing.T) {
+	expects := []Expect{reply("a"), reply("b"), reply("c")}
+	tests := []struct {
+		name   string
+		join   func(Then) *Join
+		inputs []word
+		ok     bool
+	}{
+		{"all", func(then Then) *Join { return All(then, expects...) }, []word{"c", "a", "b"}, true},
+		{"all fails", func(then Then) *Join { return All(then, expects...) }, []word{"a", "b!"}, false},
+		{"any", func(then Then) *Join { return Any(then, expects...) }, []word{"a!", "b"}, true},
+		{"any fails", func(then Then) *Join { return Any(then, expects...) }, []word{"a!", "c!", "b!"}, false},
+		{"race", func(then Then) *Join { return Race(then, expects...) }, []word{"b"}, true},
+		{"race fails", func(then Then) *Join { return Race(then, expects...) }, []word{"c!"}, false},
+		{"quorum", func(then Then) *Join { return Quorum(2, then, expects...) }, []word{"a!", "b", "c"}, true},
+		{"quorum fails", func(then Then) *Join { return Quorum(2, then, expects...) }, []word{"a!", "c!"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var finished []bool
+			var results Results
+			j := test.join(func(s State, r Results, ok bool) (State, []Out) {
+				finished = append(finished, ok)
+				results = r
+				return s, nil
+			})
+			for i, w := range test.inputs {
+				if j.Done() {
+					t.Fatalf("done before input %d", i)
+				}
+				ready, ok := j.Expected(w)
+				if !ok {
+					t.Fatalf("%q wasn't expected", w)
+				}
+				ready.Update(nil)
+			}
+			if !j.Done() || len(finished) != 1 || finished[0] != test.ok {
+				t.Fatalf("done is %v, Then got %v", j.Done(), finished)
+			}
+			if _, ok := j.Expected(word("a")); ok {
+				t.Error("a done Join expected an input")
+			}
+			if (results.Err() == nil) != (results.Failed() == 0) {
+				t.Errorf("Err is %v with %d failed", results.Err(), results.Failed())
+			}
+		})
+	}
+}
+
+func TestJoinIgnoresRepeats(t *testing.T) {
+	j := All(func(s State, _ Results, _ bool) (State, []Out) { return s, nil }, reply("a"), reply("b"))
+	ready, _ := j.Expected(word("a"))
+	ready.Update(nil)
+	if _, ok := j.Expected(word("a")); ok {
+		t.Error("a second a was expected")
+	}
+
+	c := j.Copy()
+	ready, _ = c.Expected(word("b"))
+	ready.Update(nil)
+	if !c.Done() || j.Done() {
+		t.Errorf("copy done is %v, original done is %v", c.Done(), j.Done())
+	}
+}
@@ -0,0 +1,156 @@
+package gu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"sync"
+)
+
+// Journal is an Observer that appends each input the main loop
+// receives to a file. Since the state is made only from the inputs,
+// the journal can be read back with a JournalReader to rebuild it, for
+// example in a standby process.
+//
+// The inputs are encoded with encoding/gob, so each type of input must
+// be registered with gob.Register. Each input is written before the
+// state is updated with it, but the file isn't synced, so the last few
+// may be lost if the computer crashes. A Journal is Essential, so if
+// an input can't be written then the program stops with the error,
+// before the state is updated with the input.
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+	err  error
+}
+
+// journalRecord wraps an input, so that gob encodes its type.
+type journalRecord struct {
+	In In
+}
+
+// OpenJournal opens the journal file at path, creating it if needed,
+// and adds new inputs to the end of it.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file}, nil
+}
+
+// Observe writes the input of each Received event to the journal.
+func (j *Journal) Observe(e Event) {
+	received, ok := e.(Received)
+	if !ok {
+		return
+	}
+
+	record, err := encodeRecord(journalRecord{In: received.In})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return
+	}
+	if err == nil {
+		_, err = j.file.Write(record)
+	}
+	j.err = err
+}
+
+// Err returns the first error from writing the journal. Once there has
+// been one, nothing more is written.
+func (j *Journal) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// EssentialErr returns the same as Err, so that the main loop stops
+// once the journal has failed.
+func (j *Journal) EssentialErr() error {
+	return j.Err()
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// JournalReader reads the inputs from a journal written by Journal. It
+// can read a journal that is still being written to, since a record
+// that is only partly written is treated as the end.
+type JournalReader struct {
+	r      io.ReaderAt
+	offset int64
+}
+
+// NewJournalReader makes a JournalReader that reads from the start of
+// r, which is usually the journal file.
+func NewJournalReader(r io.ReaderAt) *JournalReader {
+	return &JournalReader{r: r}
+}
+
+// Next returns the next input in the journal. It returns io.EOF if
+// there are no more complete records, in which case it can be called
+// again later to see if more have been written.
+func (r *JournalReader) Next() (In, error) {
+	var record journalRecord
+	next, err := readRecord(r.r, r.offset, &record)
+	if err != nil {
+		return nil, err
+	}
+	r.offset = next
+	return record.In, nil
+}
+
+// Offset returns the position in the journal just after the last
+// record read.
+func (r *JournalReader) Offset() int64 {
+	return r.offset
+}
+
+// encodeRecord encodes a value for a file of records. Each one is
+// encoded with its own encoder, after its length, so that the file can
+// be read from any record and added to by more than one process in
+// turn.
+func encodeRecord(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	err := gob.NewEncoder(&buf).Encode(v)
+	record := buf.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	return record, err
+}
+
+// readRecord decodes the record at offset into v, and returns the
+// offset of the next one. It returns io.EOF if the record is missing
+// or only partly written.
+func readRecord(r io.ReaderAt, offset int64, v interface{}) (int64, error) {
+	var header [4]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return offset, eof(err)
+	}
+	record := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := r.ReadAt(record, offset+4); err != nil {
+		return offset, eof(err)
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(record)).Decode(v)
+	if err != nil {
+		return offset, err
+	}
+	return offset + 4 + int64(len(record)), nil
+}
+
+func eof(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
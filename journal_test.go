@@ -0,0 +1,95 @@
+package gu
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// num is an input that can be journalled.
+type num int
+
+func (num) Router(Waiter) Ready { return nil }
+
+func (n num) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.n += int(n)
+	return c, nil
+}
+
+func init() {
+	gob.Register(num(0))
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Start(start{
+		state:     count{limit: 6},
+		outputs:   []Out{send{num(1)}, send{num(2)}, send{num(3)}},
+		observers: []Observer{journal},
+	})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	journal.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r := NewJournalReader(file)
+	total := 0
+	for {
+		in, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += int(in.(num))
+	}
+	if total != 6 {
+		t.Errorf("journal adds up to %d", total)
+	}
+}
+
+// unregistered is an input that gob can't encode.
+type unregistered struct{ N int }
+
+func (unregistered) Router(Waiter) Ready { return nil }
+
+func (unregistered) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.n = 100
+	return c, nil
+}
+
+func TestJournalFailure(t *testing.T) {
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	p := Start(start{
+		state:     count{limit: 100},
+		outputs:   []Out{send{unregistered{}}},
+		observers: []Observer{journal},
+	})
+	err = wait(t, p)
+	if err == nil || errors.Is(err, errDone) || !strings.Contains(err.Error(), "*gu.Journal failed") {
+		t.Fatalf("got %v", err)
+	}
+	if n := p.Query(func(s State) interface{} { return s.(count).n }); n != 0 {
+		t.Errorf("state was updated with the input that wasn't journalled")
+	}
+}
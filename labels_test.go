@@ -0,0 +1,54 @@
+package gu
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+// profiled is an output that writes a goroutine profile, in which its
+// own goroutine shows its labels.
+type profiled struct{ profile *bytes.Buffer }
+
+func (p profiled) Io(ch chan In) {
+	pprof.Lookup("goroutine").WriteTo(p.profile, 1)
+	ch <- inc{}
+}
+
+func (profiled) Fast() bool { return false }
+
+func TestOutputLabels(t *testing.T) {
+	var profile bytes.Buffer
+	p := Start(start{state: count{limit: 1}, outputs: []Out{profiled{&profile}}})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	if !strings.Contains(profile.String(), `"gu.out":"gu.profiled"`) {
+		t.Errorf("no label for the output in the profile:\n%s", profile.String())
+	}
+}
+
+// inspected is an input whose update writes a goroutine profile, like
+// profiled.
+type inspected struct{ profile *bytes.Buffer }
+
+func (inspected) Router(Waiter) Ready { return nil }
+
+func (i inspected) Update(s State) (State, []Out) {
+	pprof.Lookup("goroutine").WriteTo(i.profile, 1)
+	c := s.(count)
+	c.n++
+	return c, nil
+}
+
+func TestUpdateLabels(t *testing.T) {
+	var profile bytes.Buffer
+	p := Start(start{state: count{limit: 1}, outputs: []Out{send{inspected{&profile}}}})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	if !strings.Contains(profile.String(), `"gu.in":"gu.inspected"`) {
+		t.Errorf("no label for the input in the profile:\n%s", profile.String())
+	}
+}
@@ -0,0 +1,155 @@
+package gu
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OutputTracker is an Observer that keeps track of the goroutines
+// started for outputs that aren't Fast. An Io that never returns,
+// for example because it is blocked sending an input after the main
+// loop has stopped, is a goroutine leak. OutputTracker reports
+// outputs that are still running when Run returns, or that have
+// been running for longer than a maximum age.
+//
+// Outputs that are meant to run for as long as the program does,
+// such as an HTTP server, will be reported too, so use a maximum
+// age of zero if there are any.
+type OutputTracker struct {
+	maxAge time.Duration
+	w      io.Writer
+
+	mu      sync.Mutex
+	running map[[8]byte]*runningOutput
+	stopped bool
+}
+
+type runningOutput struct {
+	out      Out
+	start    time.Time
+	reported bool
+}
+
+// TB is the part of testing.TB used by the test helpers in this
+// package.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// NewOutputTracker makes an OutputTracker that writes its reports to
+// w. If maxAge is more than zero then outputs that have been running
+// for longer than it are reported, which is checked whenever the
+// main loop does something. Outputs still running when Run returns
+// are always reported.
+func NewOutputTracker(maxAge time.Duration, w io.Writer) *OutputTracker {
+	return &OutputTracker{
+		maxAge:  maxAge,
+		w:       w,
+		running: make(map[[8]byte]*runningOutput),
+	}
+}
+
+// Observe keeps track of which output goroutines are running.
+func (t *OutputTracker) Observe(event Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	switch e := event.(type) {
+	case OutputStarted:
+		if !e.Out.Fast() {
+			t.running[e.Span.SpanID] = &runningOutput{
+				out:   e.Out,
+				start: e.Time,
+			}
+		}
+
+	case OutputReturned:
+		delete(t.running, e.Span.SpanID)
+
+	case Stopped:
+		t.stopped = true
+		for _, output := range t.sorted() {
+			fmt.Fprintf(
+				t.w, "gu: output %s still running %s after the main loop stopped\n",
+				typeName(output.out), now.Sub(output.start).Round(time.Millisecond))
+			output.reported = true
+		}
+		return
+	}
+
+	if t.maxAge <= 0 {
+		return
+	}
+	for _, output := range t.sorted() {
+		age := now.Sub(output.start)
+		if !output.reported && age > t.maxAge {
+			fmt.Fprintf(
+				t.w, "gu: output %s has been running for %s\n",
+				typeName(output.out), age.Round(time.Millisecond))
+			output.reported = true
+		}
+	}
+}
+
+// Running returns the outputs whose Io is still running, oldest
+// first.
+func (t *OutputTracker) Running() []Out {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var outs []Out
+	for _, output := range t.sorted() {
+		outs = append(outs, output.out)
+	}
+	return outs
+}
+
+// Check is for tests. It fails the test if any output goroutines
+// are still running once the main loop has stopped. Io functions are
+// given up to the grace period to return before failing.
+func (t *OutputTracker) Check(tb TB, grace time.Duration) {
+	tb.Helper()
+
+	deadline := time.Now().Add(grace)
+	for {
+		t.mu.Lock()
+		stopped := t.stopped
+		leaked := t.sorted()
+		t.mu.Unlock()
+
+		if !stopped {
+			tb.Errorf("gu: Check called before the main loop stopped")
+			return
+		}
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, output := range leaked {
+				tb.Errorf(
+					"gu: output %s outlived the program",
+					typeName(output.out))
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// sorted returns the running outputs, oldest first. The lock must be
+// held.
+func (t *OutputTracker) sorted() []*runningOutput {
+	outputs := make([]*runningOutput, 0, len(t.running))
+	for _, output := range t.running {
+		outputs = append(outputs, output)
+	}
+	sort.Slice(outputs, func(i, j int) bool {
+		return outputs[i].start.Before(outputs[j].start)
+	})
+	return outputs
+}
@@ -0,0 +1,68 @@
+package gu
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTB records the failures of the test helpers.
+type fakeTB struct{ errors []string }
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+// blocked is an output that sends an inc and then blocks until its
+// channel is closed.
+type blocked struct{ release chan struct{} }
+
+func (b blocked) Io(ch chan In) {
+	ch <- inc{}
+	<-b.release
+}
+
+func (blocked) Fast() bool { return false }
+
+func TestOutputTracker(t *testing.T) {
+	var buf syncBuffer
+	tracker := NewOutputTracker(0, &buf)
+	release := make(chan struct{})
+
+	var early fakeTB
+	tracker.Check(&early, 0)
+	if len(early.errors) != 1 {
+		t.Errorf("Check before the program started gave %q", early.errors)
+	}
+
+	p := Start(start{
+		state:     count{limit: 1},
+		outputs:   []Out{blocked{release}},
+		observers: []Observer{tracker},
+	})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	if running := tracker.Running(); len(running) != 1 {
+		t.Errorf("running outputs are %v", running)
+	}
+
+	var leaked fakeTB
+	tracker.Check(&leaked, 10*time.Millisecond)
+	if len(leaked.errors) != 1 || !strings.Contains(leaked.errors[0], "gu.blocked outlived") {
+		t.Errorf("Check gave %q", leaked.errors)
+	}
+	if !strings.Contains(buf.String(), "output gu.blocked still running") {
+		t.Errorf("report is %q", buf.String())
+	}
+
+	close(release)
+	var fine fakeTB
+	tracker.Check(&fine, time.Second)
+	if len(fine.errors) != 0 {
+		t.Errorf("Check after the output returned gave %q", fine.errors)
+	}
+}
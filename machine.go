@@ -0,0 +1,85 @@
+package gu
+
+// Machine is the pure part of a program: its state, and the Waiters
+// kept for it by the main loop. Run uses one inside. It is for
+// running a program's logic in other ways, for example replicated
+// across several processes, where the inputs are applied in an agreed
+// order and only some of the processes run the outputs.
+type Machine struct {
+	m machine
+}
+
+// NewMachine makes a Machine in the initial state, and returns the
+// initial outputs.
+func NewMachine(init Init) (*Machine, []Out) {
+	m := &Machine{m: machine{state: init.InitState()}}
+	return m, m.m.direct(init.InitOutputs())
+}
+
+// Apply updates the machine with a new input, and returns the
+// outputs to run. Errors reported and inputs rejected by the update
+// are dropped, since nothing is observing the machine.
+func (m *Machine) Apply(in In) []Out {
+	outputs, _ := m.m.update(in)
+	m.m.rejected, m.m.reported = nil, nil
+	return outputs
+}
+
+// State returns the current state.
+func (m *Machine) State() State {
+	return m.m.state
+}
+
+// Copied is an optional interface for State, for a state that holds
+// values that its updates change in place, such as a Flow or a Join.
+// Copy returns a copy of the state that doesn't share them with the
+// original, for example using Flow.Copy and Join.Copy.
+type Copied interface {
+	Copy() State
+}
+
+// Clone returns a copy of the machine, which can be applied to
+// separately. The state is only copied if it implements Copied, so
+// otherwise this relies on updates making new states rather than
+// changing old ones. Flows and Joins kept by the main loop are
+// always copied.
+func (m *Machine) Clone() *Machine {
+	c := &Machine{m: m.m}
+	if copied, ok := m.m.state.(Copied); ok {
+		c.m.state = copied.Copy()
+	}
+	c.m.waiters = make([]keptWaiter, len(m.m.waiters))
+	for i, kept := range m.m.waiters {
+		switch waiter := kept.waiter.(type) {
+		case *Flow:
+			kept.waiter = waiter.Copy()
+		case *Join:
+			kept.waiter = waiter.Copy()
+		}
+		c.m.waiters[i] = kept
+	}
+	return c
+}
+
+// Start runs a main loop that carries on from the machine, beginning
+// with the given outputs, and returns a handle on it. It is for
+// promoting a machine that has been kept up to date elsewhere to be
+// the one that runs the outputs. init is only used for the optional
+// interfaces that configure the main loop, and the observers are
+// added to any that it gives. The main loop runs on a Clone of the
+// machine, so the machine itself is not changed by it, as long as the
+// state is Copied if its updates change it in place.
+func (m *Machine) Start(init Init, outputs []Out, observers ...Observer) *Program {
+	loop := newLoop(init)
+	n := len(loop.observers)
+	loop.observers = append(loop.observers[:n:n], observers...)
+
+	p := &Program{loop: loop}
+	running := m.Clone().m
+	p.loop.publish(running.state)
+	go func() {
+		p.err = p.loop.run(&running, outputs)
+		close(p.loop.done)
+	}()
+	return p
+}
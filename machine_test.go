@@ -0,0 +1,103 @@
+package gu
+
+import (
+	"testing"
+	"time"
+)
+
+// is expects the word.
+func is(w word) Expect {
+	return func(in In) (bool, error) {
+		return in == w, nil
+	}
+}
+
+// flowing is a State that holds a Flow and counts what it has done.
+type flowing struct {
+	flow *Flow
+	n    int
+}
+
+func (s flowing) Waiters() []Waiter { return []Waiter{s.flow} }
+func (flowing) FatalErr() error     { return nil }
+
+func (s flowing) Copy() State {
+	s.flow = s.flow.Copy()
+	return s
+}
+
+// awaitWords is a flow that waits for a and then b, counting each.
+func awaitWords(co *Co) {
+	for _, w := range []word{"a", "b"} {
+		co.Await(func(in In) bool { return in == w })
+		s := co.State().(flowing)
+		s.n++
+		co.SetState(s)
+	}
+}
+
+type flowingStart struct{}
+
+func (flowingStart) InitState() State {
+	flow, state, _ := StartFlow(awaitWords, flowing{})
+	s := state.(flowing)
+	s.flow = flow
+	return s
+}
+
+func (flowingStart) InitOutputs() []Out {
+	then := func(s State, _ Results, ok bool) (State, []Out) {
+		c := s.(flowing)
+		if ok {
+			c.n += 10
+		}
+		return c, nil
+	}
+	return []Out{WaitAlways("join", All(then, is("c"), is("d")))}
+}
+
+func TestCloneCopiesFlowsAndJoins(t *testing.T) {
+	m, _ := NewMachine(flowingStart{})
+	m.Apply(word("a"))
+	m.Apply(word("c"))
+	clone := m.Clone()
+
+	m.Apply(word("b"))
+	m.Apply(word("d"))
+	if n := m.State().(flowing).n; n != 12 {
+		t.Fatalf("machine has n %d, expected 12", n)
+	}
+	if clone.State().(flowing).flow.Done() {
+		t.Fatal("updating the machine finished the clone's flow")
+	}
+
+	clone.Apply(word("b"))
+	clone.Apply(word("d"))
+	if n := clone.State().(flowing).n; n != 12 {
+		t.Errorf("clone has n %d, expected 12", n)
+	}
+}
+
+func TestStartDoesntChangeMachine(t *testing.T) {
+	m, _ := NewMachine(flowingStart{})
+	p := m.Start(flowingStart{}, nil)
+	p.Send(word("a"))
+	p.Send(word("c"))
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Query(func(s State) interface{} { return s.(flowing).n }) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the program didn't update its flow")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+	p.Wait()
+
+	if _, ok := m.State().(flowing).flow.Expected(word("a")); !ok {
+		t.Error("the machine's flow was moved on by the program")
+	}
+	join := m.m.waiters[0].waiter.(*Join)
+	if join.results[0].In != nil {
+		t.Error("the machine's Join was given c by the program")
+	}
+}
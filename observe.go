@@ -0,0 +1,146 @@
+package gu
+
+import (
+	"fmt"
+	"time"
+)
+
+// Observed is an optional interface for Init. If the Init given to
+// Run implements it, then each of the Observers is told about what
+// the main loop is doing. An observed program gives each output its
+// own chan, and a goroutine that labels the inputs sent on it, until
+// the output's Io returns. So an Io mustn't send after it returns
+// unless it has called Hold.
+type Observed interface {
+	// Observers returns the Observers for the program. It is
+	// called once, when the program starts.
+	Observers() []Observer
+}
+
+// Observer watches a running program, for example to debug it or to
+// draw a diagram of it. It should not change what the program does.
+type Observer interface {
+	// Observe is called by the main loop for each thing that
+	// happens. It should return quickly, because the main loop
+	// waits for it. It may be called from more than one goroutine
+	// at once, since outputs that aren't Fast run in their own.
+	Observe(Event)
+}
+
+// Essential is an optional interface for Observer, for one that the
+// program mustn't run without, such as a Journal. After telling it
+// that an input has been received, the main loop calls EssentialErr,
+// and if it returns an error then the main loop ends with it, before
+// the state is updated with the input.
+type Essential interface {
+	EssentialErr() error
+}
+
+// Event is something that happened in the main loop. It is one of
+// the event types in this package, such as Transition, so an
+// Observer will usually contain a type switch on it.
+type Event interface {
+	event()
+}
+
+// Received is the Event for the main loop taking a new input from
+// the channel, just before it updates the state with it.
+type Received struct {
+	In   In
+	Time time.Time
+}
+
+// Transition is the Event for the main loop using a new input to
+// update the state.
+type Transition struct {
+	// In is the input that was processed.
+	In In
+
+	// Cause is the output whose Io sent In, or nil if it isn't
+	// known.
+	Cause Out
+
+	// Waiter is the Waiter that claimed In, or nil if none of
+	// them did and it was processed by In.Update.
+	Waiter Waiter
+
+	// Outputs are the new IO actions returned by the update.
+	Outputs []Out
+
+	// Span identifies the transition in the program's trace.
+	// Parent is the span of the output that caused it, or the
+	// remote span given by a TracedIn.
+	Span   SpanContext
+	Parent SpanContext
+
+	// Start and End are when the update began and finished.
+	Start time.Time
+	End   time.Time
+}
+
+// OutputStarted is the Event for the main loop starting to run an
+// output's Io.
+type OutputStarted struct {
+	Out Out
+
+	// Span identifies the output in the program's trace. Parent
+	// is the span of the transition that returned it.
+	Span   SpanContext
+	Parent SpanContext
+
+	Time time.Time
+}
+
+// OutputReturned is the Event for an output's Io returning.
+type OutputReturned struct {
+	Out  Out
+	Span SpanContext
+	Time time.Time
+}
+
+// Stopped is the Event for the main loop ending. Err is the fatal
+// error that stopped it, or an error from the runtime itself such as
+// failing to save to the Outbox, or nil if it was stopped with
+// Program.Stop. State is the final state. It is the last Event from
+// the main loop, though outputs may still be running.
+type Stopped struct {
+	Err   error
+	State State
+}
+
+// Panicked is the Event for a panic in an update or in an output's
+// Io. The Observers are told about it before the panic carries on,
+// which normally crashes the program.
+type Panicked struct {
+	Value interface{}
+	Stack []byte
+
+	// Out is the output whose Io panicked, or nil if it was an
+	// update in the main loop. State is the state before the
+	// update, or nil for an output.
+	Out   Out
+	State State
+
+	Time time.Time
+}
+
+func (Received) event()       {}
+func (Transition) event()     {}
+func (OutputStarted) event()  {}
+func (OutputReturned) event() {}
+func (Stopped) event()        {}
+func (Panicked) event()       {}
+
+// essentialErr returns the first error from the Essential Observers.
+func (l *loop) essentialErr() error {
+	for _, observer := range l.observers {
+		essential, ok := observer.(Essential)
+		if !ok {
+			continue
+		}
+		if err := essential.EssentialErr(); err != nil {
+			return fmt.Errorf("gu: %s failed: %w", typeName(observer), err)
+		}
+	}
+	return nil
+}
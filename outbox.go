@@ -0,0 +1,384 @@
+package gu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Durable is an optional interface for Out, for outputs that must be
+// run even if the program crashes. If the program has an Outbox then
+// a durable output is saved in it by the main loop, as part of the
+// transition that returned it, and is only marked as done once its
+// DurableIo succeeds. When the program is started again, the state is
+// rebuilt from the inputs saved in the Outbox, and then the outputs
+// that are not done are run again, so that the inputs they send find
+// the Waiters that were waiting for them.
+//
+// So a durable output may be run more than once, but each time it is
+// given the same key, which it can pass on to the system it calls so
+// that the system can ignore repeats.
+type Durable interface {
+	Out
+
+	// DurableIo is run instead of Io. If it returns an error then
+	// the output is left in the Outbox, to be run again when the
+	// program restarts.
+	DurableIo(ch chan In, key string) error
+}
+
+// Outboxed is an optional interface for Init, which gives the Outbox
+// for saving inputs and durable outputs. Without one, durable outputs
+// are run with Io like any other. The saved inputs are applied to the
+// initial state when the main loop starts, so a program with an
+// Outbox should be started with Run or Start, rather than from a
+// Machine that has already been updated.
+type Outboxed interface {
+	Outbox() Outbox
+}
+
+// Outbox stores the inputs of a program, so that its state can be
+// rebuilt after a crash, along with the durable outputs that have not
+// yet been run successfully. A FileOutbox is one.
+type Outbox interface {
+	// Save stores the input of a transition and the durable
+	// outputs it returned, which may be none, and returns a key for
+	// each output that is different from any other it has returned,
+	// even in an earlier run of the program.
+	//
+	// The input is nil for the initial outputs, which are saved in
+	// every run of the program. Their keys must be the same in
+	// every run, such as init-0, init-1 and so on in their order,
+	// and an output whose key is still pending from an earlier run
+	// must not be stored again, so that it is only run once more.
+	//
+	// If there are any outputs, Save should not return until they
+	// are stored safely, in one write with the input, so that one
+	// is never kept without the other. Inputs without outputs may
+	// be stored later, as long as they are kept in order and an
+	// input is only lost if all the ones after it are lost too. If
+	// Save returns an error then the main loop ends with it.
+	Save(in In, outputs []Durable) ([]string, error)
+
+	// Done marks the output with the key as having run.
+	Done(key string) error
+
+	// Pending returns the inputs that were saved before the
+	// program started, and the outputs that have been saved but are
+	// not done, both in the order they were saved. It is called
+	// when the main loop starts.
+	Pending() ([]In, []PendingOut, error)
+}
+
+// PendingOut is a durable output that has not run successfully yet.
+type PendingOut struct {
+	Key string
+	Out Durable
+}
+
+// save saves the input and the durable outputs of a transition in the
+// outbox, if there is one, and returns the key for each output. It
+// returns nil if there are no durable outputs. The input is nil for
+// the initial outputs.
+func (l *loop) save(in In, outputs []Out) ([]string, error) {
+	if l.outbox == nil {
+		return nil, nil
+	}
+
+	var durables []Durable
+	var at []int
+	for i, output := range outputs {
+		if durable, ok := output.(Durable); ok {
+			durables = append(durables, durable)
+			at = append(at, i)
+		}
+	}
+	if in == nil && len(durables) == 0 {
+		return nil, nil
+	}
+
+	saved, err := l.outbox.Save(in, durables)
+	if err != nil {
+		return nil, fmt.Errorf("gu: saving to the outbox: %w", err)
+	}
+	if len(durables) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(outputs))
+	for i, key := range saved {
+		keys[at[i]] = key
+	}
+	return keys, nil
+}
+
+// io runs an output's Io. If it has a key then it is a saved durable
+// output, which is marked as done when it succeeds.
+func (l *loop) io(output Out, key string, ch chan In, span SpanContext) {
+	durable, isDurable := output.(Durable)
+	traced, isTraced := output.(TracedOut)
+	switch {
+	case isDurable && key != "":
+		if durable.DurableIo(ch, key) == nil {
+			// If this fails then the output is run again
+			// after a restart, which its key allows for.
+			l.outbox.Done(key)
+		}
+	case isTraced && span.IsValid():
+		traced.TracedIo(ch, span)
+	default:
+		output.Io(ch)
+	}
+}
+
+// FileOutbox is an Outbox that keeps the inputs and outputs in a
+// file. They are encoded with encoding/gob, so each type of input and
+// durable output must be registered with gob.Register. The file is
+// only synced when a transition returns durable outputs, which also
+// makes the inputs before it safe. The inputs are never removed, like
+// the inputs in a Journal.
+type FileOutbox struct {
+	mu      sync.Mutex
+	file    *os.File
+	seq     uint64
+	inputs  []In
+	pending []PendingOut
+}
+
+// outboxRecord is an input and the outputs saved with it, or a key
+// that is done.
+type outboxRecord struct {
+	Seq  uint64
+	In   In
+	Keys []string
+	Outs []Durable
+	Done string
+}
+
+// OpenFileOutbox opens the outbox file at path, creating it if needed.
+// The outputs that are done are removed from the file.
+func OpenFileOutbox(path string) (*FileOutbox, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	o := &FileOutbox{}
+	records, err := o.load(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// The file is rewritten without the outputs that are done,
+	// which also cuts off a record that was only partly written.
+	// The first record keeps the count of calls to Save.
+	var buf bytes.Buffer
+	for _, record := range append([]outboxRecord{{Seq: o.seq}}, records...) {
+		encoded, err := encodeRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encoded)
+	}
+	err = writeFile(path+".tmp", buf.Bytes())
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	o.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// load reads the file, and returns its records without the outputs
+// that are done.
+func (o *FileOutbox) load(file *os.File) ([]outboxRecord, error) {
+	var records []outboxRecord
+	done := make(map[string]bool)
+	var offset int64
+	for {
+		var record outboxRecord
+		next, err := readRecord(file, offset, &record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+
+		o.seq = max(o.seq, record.Seq)
+		if record.Done != "" {
+			done[record.Done] = true
+		} else {
+			records = append(records, record)
+		}
+	}
+
+	var kept []outboxRecord
+	for _, record := range records {
+		k := outboxRecord{Seq: record.Seq, In: record.In}
+		for i, key := range record.Keys {
+			if !done[key] {
+				k.Keys = append(k.Keys, key)
+				k.Outs = append(k.Outs, record.Outs[i])
+				o.pending = append(o.pending, PendingOut{Key: key, Out: record.Outs[i]})
+			}
+		}
+		if k.In != nil {
+			o.inputs = append(o.inputs, k.In)
+		}
+		if k.In != nil || len(k.Keys) > 0 {
+			kept = append(kept, k)
+		}
+	}
+	return kept, nil
+}
+
+// writeFile writes a new file and syncs it.
+func writeFile(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Save adds the input and outputs to the file as one record, and syncs
+// it if there are any outputs. The keys are made from a count of the
+// calls to Save, which is kept in the file, and the position of the
+// output in the list. The keys of the initial outputs are init-0,
+// init-1 and so on, and those that are still pending are left out of
+// the record.
+func (o *FileOutbox) Save(in In, outputs []Durable) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	record := outboxRecord{Seq: o.seq + 1, In: in}
+	keys := make([]string, len(outputs))
+	for i, output := range outputs {
+		keys[i] = fmt.Sprintf("%d-%d", record.Seq, i)
+		if in == nil {
+			keys[i] = fmt.Sprintf("init-%d", i)
+		}
+		if !o.isPending(keys[i]) {
+			record.Keys = append(record.Keys, keys[i])
+			record.Outs = append(record.Outs, output)
+		}
+	}
+	if in == nil && len(record.Keys) == 0 {
+		return keys, nil
+	}
+	encoded, err := encodeRecord(record)
+	if err == nil {
+		_, err = o.file.Write(encoded)
+	}
+	if err == nil && len(outputs) > 0 {
+		err = o.file.Sync()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	o.seq = record.Seq
+	for i, key := range record.Keys {
+		o.pending = append(o.pending, PendingOut{Key: key, Out: record.Outs[i]})
+	}
+	return keys, nil
+}
+
+func (o *FileOutbox) isPending(key string) bool {
+	for _, p := range o.pending {
+		if p.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Done adds a record to the file that the output is done. The file
+// isn't synced, since the worst that can happen if the record is lost
+// is that the output is run again.
+func (o *FileOutbox) Done(key string) error {
+	record, err := encodeRecord(outboxRecord{Done: key})
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := o.file.Write(record); err != nil {
+		return err
+	}
+	o.remove(key)
+	return nil
+}
+
+func (o *FileOutbox) remove(key string) {
+	for i, p := range o.pending {
+		if p.Key == key {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pending returns the inputs that were in the file when it was opened,
+// and the outputs that are not done.
+func (o *FileOutbox) Pending() ([]In, []PendingOut, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.inputs, append([]PendingOut(nil), o.pending...), nil
+}
+
+// Close closes the file.
+func (o *FileOutbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
+
+// restart rebuilds the state from the inputs saved in the outbox, and
+// runs the durable outputs that were left pending when the program
+// last stopped. The other outputs of the saved inputs are dropped,
+// since they were run before. It returns the keys of the outputs it
+// started, so that an initial output that was pending isn't started
+// again.
+func (l *loop) restart(m *machine, span SpanContext) map[string]bool {
+	if l.outbox == nil {
+		return nil
+	}
+	inputs, pending, err := l.outbox.Pending()
+	if err != nil {
+		l.err = fmt.Errorf("gu: reading the outbox: %w", err)
+		return nil
+	}
+	for _, in := range inputs {
+		m.update(in)
+		if l.shadow != nil {
+			if _, panicked := l.shadow.update(in); panicked != nil {
+				l.shadow = nil
+			}
+		}
+	}
+	l.publish(m.state)
+	started := make(map[string]bool, len(pending))
+	for _, p := range pending {
+		l.start(p.Out, p.Key, span)
+		started[p.Key] = true
+	}
+	return started
+}
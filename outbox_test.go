@@ -0,0 +1,245 @@
+package gu
+
+import (
+	"encoding/gob"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Begin is an input that starts a payment, which waits for a Paid.
+type Begin struct{ Key string }
+
+func (Begin) Router(Waiter) Ready { return nil }
+
+func (b Begin) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.waiters = append(c.waiters[:len(c.waiters):len(c.waiters)], awaitPaid{b.Key})
+	return c, []Out{Charge{b.Key}}
+}
+
+// Paid is sent by Charge once it has succeeded.
+type Paid struct{ Key string }
+
+func (Paid) Router(Waiter) Ready           { return nil }
+func (Paid) Update(s State) (State, []Out) { return s, nil }
+
+type awaitPaid struct{ key string }
+
+func (w awaitPaid) Expected(in In) (Ready, bool) {
+	if paid, ok := in.(Paid); ok && paid.Key == w.key {
+		return paidReady{w.key}, true
+	}
+	return nil, false
+}
+
+type paidReady struct{ key string }
+
+func (r paidReady) Update(s State) (State, []Out) {
+	c := s.(count)
+	var waiters []Waiter
+	for _, w := range c.waiters {
+		if w != (awaitPaid{r.key}) {
+			waiters = append(waiters, w)
+		}
+	}
+	c.waiters = waiters
+	c.n++
+	return c, nil
+}
+
+// charging says whether Charge succeeds, and counts its runs.
+var (
+	charging atomic.Bool
+	charges  atomic.Int32
+)
+
+// Charge is a durable output, which sends Paid if charging is true.
+type Charge struct{ Key string }
+
+func (Charge) Io(chan In) { panic("Io run instead of DurableIo") }
+func (Charge) Fast() bool { return false }
+
+func (c Charge) DurableIo(ch chan In, key string) error {
+	charges.Add(1)
+	if !charging.Load() {
+		return errors.New("payment service is down")
+	}
+	ch <- Paid{c.Key}
+	return nil
+}
+
+func init() {
+	gob.Register(Begin{})
+	gob.Register(Paid{})
+	gob.Register(Charge{})
+}
+
+type outboxStart struct {
+	start
+	outbox Outbox
+}
+
+func (o outboxStart) Outbox() Outbox { return o.outbox }
+
+func paidCount(p *Program) int {
+	return p.Query(func(s State) interface{} { return s.(count).n }).(int)
+}
+
+func TestOutboxRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	charging.Store(false)
+	charges.Store(0)
+
+	// The first run saves the Begin with its Charge, which fails.
+	outbox, err := OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Start(outboxStart{start: start{state: count{}}, outbox: outbox})
+	p.Send(Begin{"a"})
+	deadline := time.Now().Add(5 * time.Second)
+	for charges.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+	if err := wait(t, p); err != nil {
+		t.Fatal(err)
+	}
+	outbox.Close()
+
+	// The restart rebuilds the Waiter from the Begin and runs the
+	// Charge again, and the Paid it sends finds the Waiter.
+	charging.Store(true)
+	outbox, err = OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, pending, _ := outbox.Pending()
+	if len(inputs) != 1 || len(pending) != 1 || pending[0].Key != "1-0" {
+		t.Fatalf("outbox has inputs %v and outputs %v", inputs, pending)
+	}
+	p = Start(outboxStart{start: start{state: count{}}, outbox: outbox})
+	for paidCount(p) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Paid didn't reach its Waiter")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+	wait(t, p)
+	outbox.Close()
+
+	// Both runs are kept, so the state is rebuilt with the Paid,
+	// and the Charge is done.
+	outbox, err = OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	inputs, pending, _ = outbox.Pending()
+	if len(inputs) != 2 || len(pending) != 0 {
+		t.Fatalf("outbox has inputs %v and outputs %v", inputs, pending)
+	}
+	p = Start(outboxStart{start: start{state: count{}}, outbox: outbox})
+	defer p.Stop()
+	if n := paidCount(p); n != 1 {
+		t.Errorf("rebuilt state has count %d", n)
+	}
+	if len(p.Waiters()) != 0 {
+		t.Errorf("rebuilt state has Waiters %v", p.Waiters())
+	}
+}
+
+func TestFileOutboxKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	outbox, err := OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := outbox.Save(Begin{"a"}, []Durable{Charge{"a"}, Charge{"b"}})
+	if err != nil || len(keys) != 2 || keys[0] != "1-0" || keys[1] != "1-1" {
+		t.Fatalf("got keys %v: %v", keys, err)
+	}
+	outbox.Done(keys[0])
+	outbox.Close()
+
+	outbox, err = OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	_, pending, _ := outbox.Pending()
+	if len(pending) != 1 || pending[0].Key != "1-1" {
+		t.Fatalf("pending outputs are %v", pending)
+	}
+	keys, _ = outbox.Save(Begin{"c"}, []Durable{Charge{"c"}})
+	if len(keys) != 1 || keys[0] != "2-0" {
+		t.Errorf("keys after reopening are %v", keys)
+	}
+
+	// The initial outputs have the same keys each time, and aren't
+	// stored again while they are pending.
+	for i := 0; i < 2; i++ {
+		keys, _ = outbox.Save(nil, []Durable{Charge{"d"}})
+		if len(keys) != 1 || keys[0] != "init-0" {
+			t.Errorf("initial keys are %v", keys)
+		}
+	}
+	if _, pending, _ = outbox.Pending(); len(pending) != 3 {
+		t.Errorf("pending outputs are %v", pending)
+	}
+}
+
+func TestOutboxInitialOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+	charging.Store(false)
+	charges.Store(0)
+	init := func(outbox Outbox) Init {
+		return outboxStart{start: start{state: count{}, outputs: []Out{Charge{"i"}}}, outbox: outbox}
+	}
+
+	outbox, err := OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Start(init(outbox))
+	deadline := time.Now().Add(5 * time.Second)
+	for charges.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+	wait(t, p)
+	outbox.Close()
+
+	// The restart runs the pending initial output once, with the
+	// same key, rather than saving it again.
+	charging.Store(true)
+	charges.Store(0)
+	outbox, err = OpenFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	_, pending, _ := outbox.Pending()
+	if len(pending) != 1 || pending[0].Key != "init-0" {
+		t.Fatalf("pending outputs are %v", pending)
+	}
+	p = Start(init(outbox))
+	defer p.Stop()
+	for {
+		if _, pending, _ = outbox.Pending(); len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still pending: %v", pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := charges.Load(); n != 1 {
+		t.Errorf("the initial output ran %d times", n)
+	}
+}
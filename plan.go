@@ -0,0 +1,173 @@
+package gu
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Job is one step in a Plan. It is an output to run once the jobs it
+// comes after have succeeded.
+type Job struct {
+	// Name is used by other jobs to say that they come after this
+	// one, and as the key for its result.
+	Name string
+
+	// After are the names of the jobs that must succeed before
+	// this one starts.
+	After []string
+
+	// Out makes the output for the job from the results of the
+	// jobs it comes after. The output's Io must send exactly one
+	// input before it returns, which is the job's result. If the
+	// input implements error, or the Io returns without sending
+	// anything, then the job has failed.
+	Out func(after map[string]In) Out
+}
+
+// Plan returns an output that runs a set of jobs, each one starting
+// once the jobs it comes after have succeeded. It is for sequences
+// of IO actions like "run B after A succeeds, then C", that need no
+// logic in between, so that writing Waiters for them is not worth it.
+// Jobs that don't depend on each other are run at the same time.
+//
+// Once all the jobs have succeeded, or one has failed, done is called
+// with the results so far, keyed by job name, and the input it
+// returns is sent to the main loop. err is nil if all the jobs
+// succeeded. Jobs that are still running when one fails are left to
+// finish, but their results are dropped.
+func Plan(done func(results map[string]In, err error) In, jobs ...Job) Out {
+	return plan{jobs: jobs, done: done}
+}
+
+type plan struct {
+	jobs []Job
+	done func(map[string]In, error) In
+}
+
+// jobResult is the input sent by a job's Io, or an error if it
+// didn't send one.
+type jobResult struct {
+	name string
+	in   In
+	err  error
+}
+
+func (p plan) Io(ch chan In) {
+	ch <- p.run()
+}
+
+func (plan) Fast() bool {
+	return false
+}
+
+func (p plan) run() In {
+	results := make(map[string]In, len(p.jobs))
+	if err := p.check(); err != nil {
+		return p.done(results, err)
+	}
+
+	finished := make(chan jobResult, len(p.jobs))
+	started := make(map[string]bool, len(p.jobs))
+	for len(results) < len(p.jobs) {
+		for _, job := range p.jobs {
+			if started[job.Name] || !ready(job, results) {
+				continue
+			}
+			started[job.Name] = true
+			after := make(map[string]In, len(job.After))
+			for _, name := range job.After {
+				after[name] = results[name]
+			}
+			go runJob(job.Name, job.Out(after), finished)
+		}
+
+		result := <-finished
+		if result.err != nil {
+			return p.done(results, fmt.Errorf("gu: job %s failed: %w", result.name, result.err))
+		}
+		results[result.name] = result.in
+		if err, failed := result.in.(error); failed {
+			return p.done(results, fmt.Errorf("gu: job %s failed: %w", result.name, err))
+		}
+	}
+	return p.done(results, nil)
+}
+
+func ready(job Job, results map[string]In) bool {
+	for _, name := range job.After {
+		if _, ok := results[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// runJob runs a job's output and sends on its result. As in
+// loop.finish, the Io returning is noticed, so that a job that sends
+// nothing fails instead of holding up the plan for ever.
+func runJob(name string, output Out, finished chan jobResult) {
+	ch := make(chan In, 1)
+	returned := make(chan struct{})
+	go func() {
+		output.Io(ch)
+		close(returned)
+	}()
+
+	select {
+	case in := <-ch:
+		finished <- jobResult{name: name, in: in}
+	case <-returned:
+		select {
+		case in := <-ch:
+			finished <- jobResult{name: name, in: in}
+		default:
+			finished <- jobResult{name: name, err: fmt.Errorf("%s returned without sending a result", typeName(output))}
+		}
+	}
+}
+
+// check makes sure that the job names are unique, that the jobs
+// they come after exist, and that there are no cycles.
+func (p plan) check() error {
+	jobs := make(map[string]Job, len(p.jobs))
+	for _, job := range p.jobs {
+		if _, ok := jobs[job.Name]; ok {
+			return fmt.Errorf("gu: more than one job called %s", job.Name)
+		}
+		jobs[job.Name] = job
+	}
+
+	// Jobs are visited depth first. A job that is reached again
+	// while it is still being visited is part of a cycle.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(jobs))
+	var visit func(name string) error
+	visit = func(name string) error {
+		job, ok := jobs[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("gu: no job called %s", name)
+		case state[name] == visiting:
+			return errors.New("gu: jobs depend on each other in a cycle")
+		case state[name] == visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, after := range job.After {
+			if err := visit(after); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, job := range p.jobs {
+		if err := visit(job.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
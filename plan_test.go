@@ -0,0 +1,110 @@
+package gu
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// planDone is the input made when a Plan finishes.
+type planDone struct {
+	results map[string]In
+	err     error
+}
+
+func (planDone) Router(Waiter) Ready           { return nil }
+func (planDone) Update(s State) (State, []Out) { return s, nil }
+
+func finishPlan(results map[string]In, err error) In {
+	return planDone{results: results, err: err}
+}
+
+// word is a job result.
+type word string
+
+func (word) Router(Waiter) Ready           { return nil }
+func (word) Update(s State) (State, []Out) { return s, nil }
+
+// failed is a job result for a job that failed.
+type failed struct{ error }
+
+func (failed) Router(Waiter) Ready           { return nil }
+func (failed) Update(s State) (State, []Out) { return s, nil }
+
+// silent is an output that sends nothing.
+type silent struct{}
+
+func (silent) Io(chan In) {}
+func (silent) Fast() bool { return false }
+
+func sendJob(name string, in In, after ...string) Job {
+	return Job{
+		Name:  name,
+		After: after,
+		Out:   func(map[string]In) Out { return send{in} },
+	}
+}
+
+func runPlan(jobs ...Job) planDone {
+	return Plan(finishPlan, jobs...).(plan).run().(planDone)
+}
+
+func TestPlan(t *testing.T) {
+	done := runPlan(
+		sendJob("a", word("a")),
+		sendJob("b", word("b")),
+		Job{
+			Name:  "ab",
+			After: []string{"a", "b"},
+			Out: func(after map[string]In) Out {
+				return send{after["a"].(word) + after["b"].(word)}
+			},
+		},
+	)
+	if done.err != nil {
+		t.Fatal(done.err)
+	}
+	if done.results["ab"] != word("ab") {
+		t.Errorf("results are %v", done.results)
+	}
+}
+
+func TestPlanFailure(t *testing.T) {
+	done := runPlan(
+		sendJob("a", failed{errors.New("broken")}),
+		sendJob("b", word("b"), "a"),
+	)
+	if done.err == nil || !strings.Contains(done.err.Error(), "job a failed: broken") {
+		t.Errorf("got %v", done.err)
+	}
+	if _, ok := done.results["b"]; ok {
+		t.Error("job b ran after job a failed")
+	}
+}
+
+func TestPlanSilentJob(t *testing.T) {
+	done := runPlan(
+		Job{Name: "a", Out: func(map[string]In) Out { return silent{} }},
+		sendJob("b", word("b"), "a"),
+	)
+	if done.err == nil || !strings.Contains(done.err.Error(), "job a failed: gu.silent returned without sending a result") {
+		t.Errorf("got %v", done.err)
+	}
+}
+
+func TestPlanCheck(t *testing.T) {
+	tests := []struct {
+		jobs []Job
+		err  string
+	}{
+		{[]Job{sendJob("a", word("a")), sendJob("a", word("a"))}, "more than one job called a"},
+		{[]Job{sendJob("a", word("a"), "b")}, "no job called b"},
+		{[]Job{sendJob("a", word("a"), "b"), sendJob("b", word("b"), "a")}, "cycle"},
+	}
+	for _, test := range tests {
+		done := runPlan(test.jobs...)
+		if done.err == nil || !strings.Contains(done.err.Error(), test.err) {
+			t.Errorf("got %v, expected %q", done.err, test.err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package gu
+
+import (
+	"sync"
+)
+
+// Program is a handle on a main loop started with Start. It is for
+// running a gu state machine as one part of a larger program, where
+// other goroutines need to send it messages or stop it. All its
+// methods are safe to call from any goroutine.
+type Program struct {
+	loop     *loop
+	stopOnce sync.Once
+
+	// err is set before loop.done is closed.
+	err error
+}
+
+// Start runs the main loop in a new goroutine and returns a handle
+// on it. It is like Run, except that it doesn't wait for the main
+// loop to end. A panic in an update or a Fast output happens in that
+// goroutine, so it can't be recovered.
+func Start(init Init) *Program {
+	m, outputs := NewMachine(init)
+	return m.Start(init, outputs)
+}
+
+// Send gives the main loop a new input, just as if it came from an
+// output's Io. It blocks until the input is in the main loop's
+// channel, which holds one input, or the program ends, in which case
+// the input is dropped. So when Send returns the input may not have
+// been processed yet.
+func (p *Program) Send(in In) {
+	select {
+	case p.loop.inChan <- in:
+	case <-p.loop.done:
+	}
+}
+
+// Stop asks the main loop to end once it has finished the step it is
+// on. It doesn't wait for it to end, so use Wait or Done for that.
+// Outputs that are still running are not stopped.
+func (p *Program) Stop() {
+	p.stopOnce.Do(func() { close(p.loop.stop) })
+}
+
+// Wait blocks until the main loop has ended. It returns the fatal
+// error from the state, or an error from the runtime itself such as
+// failing to save to the Outbox or an Essential Observer failing, or
+// nil if the program was stopped with Stop.
+func (p *Program) Wait() error {
+	<-p.loop.done
+	return p.err
+}
+
+// Done returns a channel that is closed when the main loop has ended.
+func (p *Program) Done() <-chan struct{} {
+	return p.loop.done
+}
@@ -0,0 +1,78 @@
+package gu
+
+// Query is a pure function that reads the state, for example to
+// report a metric or answer an HTTP request. It must not change
+// the state or anything it refers to.
+type Query func(State) interface{}
+
+// QueryMode says how Program.Query gets at the state, which is owned
+// by the main loop.
+type QueryMode int
+
+const (
+	// AskLoop sends each query to the main loop, which runs it
+	// between transitions. The answer is always up to date, but
+	// queries have to wait for the main loop to finish what it is
+	// doing.
+	AskLoop QueryMode = iota
+
+	// ReadSnapshot makes the main loop publish the state after
+	// each transition, and queries are run on the latest one in
+	// the goroutine that asked, without waiting for the main loop.
+	// It only works if updates never change a state, but always
+	// make a new one, since the old one may still be being read.
+	ReadSnapshot
+)
+
+// Queried is an optional interface for Init, which chooses how
+// Program.Query works. If the Init doesn't implement it then AskLoop
+// is used.
+type Queried interface {
+	QueryMode() QueryMode
+}
+
+// query is run by the main loop between transitions.
+type query struct {
+	ask    func(*machine) interface{}
+	answer chan interface{}
+}
+
+// snapshot wraps a State, since an atomic.Value must always hold the
+// same concrete type.
+type snapshot struct {
+	state State
+}
+
+// Query runs a pure function on the state of the program and returns
+// its result. It is safe to call from any goroutine. Once the main
+// loop has ended the query is run on the final state.
+func (p *Program) Query(ask Query) interface{} {
+	l := p.loop
+	if l.queryMode == ReadSnapshot {
+		return ask(l.latest())
+	}
+
+	return l.ask(func(m *machine) interface{} {
+		return ask(m.state)
+	})
+}
+
+// ask runs a function on the machine in the main loop, or on the
+// final machine if the main loop has ended.
+func (l *loop) ask(f func(*machine) interface{}) interface{} {
+	answer := make(chan interface{}, 1)
+	select {
+	case l.queries <- query{ask: f, answer: answer}:
+		return <-answer
+	case <-l.done:
+		return f(l.final)
+	}
+}
+
+func (l *loop) publish(state State) {
+	l.snapshot.Store(snapshot{state})
+}
+
+func (l *loop) latest() State {
+	return l.snapshot.Load().(snapshot).state
+}
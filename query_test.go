@@ -0,0 +1,48 @@
+package gu
+
+import (
+	"testing"
+	"time"
+)
+
+// snapshots is an Init that asks for ReadSnapshot queries.
+type snapshots struct{ start }
+
+func (snapshots) QueryMode() QueryMode { return ReadSnapshot }
+
+func counted(s State) interface{} { return s.(count).n }
+
+// eventually polls the query until it answers n.
+func eventually(t *testing.T, p *Program, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Query(counted) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("query answered %v, expected %d", p.Query(counted), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	for name, init := range map[string]Init{
+		"ask loop":      start{state: count{limit: 2}},
+		"read snapshot": snapshots{start{state: count{limit: 2}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := Start(init)
+			eventually(t, p, 0)
+			p.Send(inc{})
+			eventually(t, p, 1)
+			p.Send(inc{})
+			if err := wait(t, p); err != errDone {
+				t.Fatalf("got %v", err)
+			}
+
+			// Once the program has stopped the final state is used.
+			if n := p.Query(counted); n != 2 {
+				t.Errorf("final query answered %v", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package raft
+
+import (
+	"sync"
+)
+
+// Network is a Transport that connects nodes in the same process. It
+// is for testing, and can cut nodes off to simulate failures.
+type Network struct {
+	mu    sync.Mutex
+	nodes map[NodeID]*Node
+	cut   map[NodeID]bool
+}
+
+// NewNetwork makes an empty Network.
+func NewNetwork() *Network {
+	return &Network{
+		nodes: make(map[NodeID]*Node),
+		cut:   make(map[NodeID]bool),
+	}
+}
+
+// Add connects a node to the network, so that messages sent to its
+// ID are delivered to it.
+func (net *Network) Add(id NodeID, node *Node) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.nodes[id] = node
+}
+
+// Disconnect cuts a node off, so that messages to and from it are
+// lost.
+func (net *Network) Disconnect(id NodeID) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.cut[id] = true
+}
+
+// Reconnect undoes Disconnect.
+func (net *Network) Reconnect(id NodeID) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	delete(net.cut, id)
+}
+
+// Send delivers a message, unless either end is disconnected.
+func (net *Network) Send(msg Message) {
+	net.mu.Lock()
+	node, ok := net.nodes[msg.To]
+	lost := net.cut[msg.From] || net.cut[msg.To]
+	net.mu.Unlock()
+
+	if ok && !lost {
+		node.Receive(msg)
+	}
+}
@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"github.com/8n8/gu"
+)
+
+// NodeID names a node in the cluster.
+type NodeID string
+
+// EntryKind says what an Entry in the log is for.
+type EntryKind int
+
+const (
+	// InputEntry is an input to be applied to the program.
+	InputEntry EntryKind = iota
+
+	// ConfigEntry changes the members of the cluster.
+	ConfigEntry
+
+	// NoopEntry is added by each new leader, so that it can find
+	// out which entries are committed.
+	NoopEntry
+)
+
+// Entry is an entry in the replicated log.
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Kind  EntryKind
+
+	// In is the input for an InputEntry.
+	In gu.In
+
+	// Members are the new members of the cluster for a
+	// ConfigEntry.
+	Members []NodeID
+}
+
+// MessageType says what a Message is for.
+type MessageType int
+
+const (
+	// VoteRequest asks for a vote from a candidate.
+	VoteRequest MessageType = iota
+	VoteResponse
+
+	// AppendRequest sends new log entries from the leader, or no
+	// entries as a heartbeat.
+	AppendRequest
+	AppendResponse
+
+	// SnapshotRequest sends a snapshot from the leader to a node
+	// that is so far behind that the entries it needs are gone.
+	// It is answered with an AppendResponse.
+	SnapshotRequest
+
+	// ProposeRequest passes on inputs sent by outputs that were
+	// run on a node that is no longer the leader, as InputEntries,
+	// to the node it thinks is the leader now.
+	ProposeRequest
+)
+
+// Message is sent between nodes by a Transport.
+type Message struct {
+	Type MessageType
+	From NodeID
+	To   NodeID
+	Term uint64
+
+	// LastIndex and LastTerm describe the end of a candidate's log
+	// in a VoteRequest.
+	LastIndex uint64
+	LastTerm  uint64
+
+	// Granted is whether a VoteResponse gives the vote.
+	Granted bool
+
+	// PrevIndex and PrevTerm describe the entry before Entries in
+	// an AppendRequest. Commit is the leader's commit index.
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []Entry
+	Commit    uint64
+
+	// Success is whether an AppendResponse accepts the entries.
+	// Match is the index that the follower's log matches the
+	// leader's up to, or a hint of where to try next if it
+	// doesn't.
+	Success bool
+	Match   uint64
+
+	Snapshot *Snapshot
+}
+
+// Snapshot is the program as it was after applying the log up to
+// Index, so the entries up to there can be thrown away.
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []NodeID
+
+	// Machine is not changed once it is in a snapshot, since
+	// it is a Clone. If the state holds Flows or Joins then it must
+	// implement gu.Copied for that to be true. A Transport that
+	// goes over a real network would need to encode its state.
+	Machine *gu.Machine
+}
+
+// Transport sends messages to other nodes. Messages may be lost, so
+// Send should not block for long. A node is given the messages sent
+// to it by calling its Receive method.
+type Transport interface {
+	Send(Message)
+}
@@ -0,0 +1,708 @@
+/*
+Package raft runs a gu program as a replicated state machine, using
+the Raft consensus algorithm.
+
+The state of a gu program is a fold of its inputs with the pure
+update functions, so if several nodes apply the same inputs in the
+same order they all end up with the same state. Each input is first
+added to a log that the nodes agree on with Raft, and once it is
+committed every node applies it. Only the leader runs the outputs,
+and the inputs their Io sends are proposed to the log in turn. If
+the node has stopped being the leader by then, the inputs are passed
+on to the new one, once it is known. The initial outputs are run by
+each node when it becomes the leader.
+
+Outputs are run at most once: if the leader fails, the outputs of
+the inputs it had applied but not yet run are lost, so programs that
+need them run again should retry them from their pure logic.
+
+The log is kept in memory, so a node that is restarted must join the
+cluster as a new node, with AddNode. Package raft includes a
+Network that connects nodes in the same process, for testing.
+*/
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+// Config is the settings for a node.
+type Config struct {
+	ID NodeID
+
+	// Members are the nodes in the cluster when it starts,
+	// including this one. It is empty for a node that is going to
+	// be added to an existing cluster with AddNode.
+	Members []NodeID
+
+	Transport Transport
+
+	// Tick is how often the node checks for timeouts. It defaults
+	// to 10ms.
+	Tick time.Duration
+
+	// ElectionTicks is how many ticks a follower waits to hear
+	// from the leader before it calls an election. The actual wait
+	// is random, between this and twice this. The leader sends
+	// heartbeats three times as often. It defaults to 10.
+	ElectionTicks int
+
+	// SnapshotEvery is how many entries are applied between
+	// snapshots. It defaults to 1000.
+	SnapshotEvery uint64
+}
+
+// ErrNotLeader is returned when asking a node that isn't the leader
+// to change the log. Node.Leader says which node is, if it is known.
+var ErrNotLeader = errors.New("raft: not the leader")
+
+// ErrStopped is returned when asking a node that has stopped to do
+// something.
+var ErrStopped = errors.New("raft: node stopped")
+
+// ErrChangePending is returned when asking to change the members of
+// the cluster while another change is not yet committed.
+var ErrChangePending = errors.New("raft: a change of members is pending")
+
+// maxBatch is the most entries sent in one AppendRequest.
+const maxBatch = 64
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Node is a member of a cluster running a gu program.
+type Node struct {
+	cfg Config
+
+	inbox    chan Message
+	requests chan func()
+	outputs  chan gu.In
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// The rest is only used by the node's goroutine.
+
+	role     role
+	term     uint64
+	votedFor NodeID
+	leader   NodeID
+
+	// log[0] is the last entry covered by the snapshot, or a zero
+	// entry if there isn't one.
+	log      []Entry
+	snapshot *Snapshot
+	commit   uint64
+	applied  uint64
+
+	machine     *gu.Machine
+	initOutputs []gu.Out
+
+	// members are from the latest ConfigEntry in the log, or else
+	// from the snapshot or Config.
+	members     []NodeID
+	baseMembers []NodeID
+
+	votes map[NodeID]bool
+	next  map[NodeID]uint64
+	match map[NodeID]uint64
+
+	elapsed int
+	timeout int
+
+	// unsent are inputs from outputs that are waiting for a leader
+	// to be known, so that they can be passed on to it.
+	unsent []gu.In
+
+	err error
+}
+
+// Start starts a node running the program.
+func Start(cfg Config, init gu.Init) *Node {
+	if cfg.Tick <= 0 {
+		cfg.Tick = 10 * time.Millisecond
+	}
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = 10
+	}
+	if cfg.SnapshotEvery == 0 {
+		cfg.SnapshotEvery = 1000
+	}
+
+	machine, outputs := gu.NewMachine(init)
+	n := &Node{
+		cfg:         cfg,
+		inbox:       make(chan Message, 256),
+		requests:    make(chan func()),
+		outputs:     make(chan gu.In, 64),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		log:         []Entry{{}},
+		machine:     machine,
+		initOutputs: outputs,
+		members:     cfg.Members,
+		baseMembers: cfg.Members,
+	}
+	n.resetTimer()
+	go n.run()
+	return n
+}
+
+// Receive gives the node a message from another node. It never
+// blocks: if the node is too busy the message is dropped, as if it
+// were lost by the network.
+func (n *Node) Receive(msg Message) {
+	select {
+	case n.inbox <- msg:
+	default:
+	}
+}
+
+// Propose asks for an input to be added to the log. It returns
+// ErrNotLeader if this node isn't the leader. A nil error doesn't
+// mean the input will be committed, since the leader may fail first.
+func (n *Node) Propose(in gu.In) error {
+	var err error
+	if !n.do(func() { err = n.propose(in) }) {
+		return ErrStopped
+	}
+	return err
+}
+
+// AddNode asks for a node to be added to the cluster. The new node
+// should be started with no Members.
+func (n *Node) AddNode(id NodeID) error {
+	return n.changeMembers(func(members []NodeID) []NodeID {
+		for _, member := range members {
+			if member == id {
+				return members
+			}
+		}
+		return append(members[:len(members):len(members)], id)
+	})
+}
+
+// RemoveNode asks for a node to be removed from the cluster.
+func (n *Node) RemoveNode(id NodeID) error {
+	return n.changeMembers(func(members []NodeID) []NodeID {
+		var kept []NodeID
+		for _, member := range members {
+			if member != id {
+				kept = append(kept, member)
+			}
+		}
+		return kept
+	})
+}
+
+// Leader returns the node that this node thinks is the leader, or ""
+// if it doesn't know.
+func (n *Node) Leader() NodeID {
+	var id NodeID
+	n.do(func() { id = n.leader })
+	return id
+}
+
+// Members returns the members of the cluster, as far as this node
+// knows.
+func (n *Node) Members() []NodeID {
+	var members []NodeID
+	n.do(func() { members = n.members })
+	return members
+}
+
+// Query runs a pure function on the state of the program on this
+// node, which may be behind the leader.
+func (n *Node) Query(ask gu.Query) interface{} {
+	var answer interface{}
+	n.do(func() { answer = ask(n.machine.State()) })
+	return answer
+}
+
+// Stop stops the node.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() { close(n.stop) })
+	<-n.done
+}
+
+// Wait blocks until the node has stopped. It returns the fatal error
+// from the state, if that is what stopped it.
+func (n *Node) Wait() error {
+	<-n.done
+	return n.err
+}
+
+// do runs f in the node's goroutine. It returns false if the node
+// has stopped.
+func (n *Node) do(f func()) bool {
+	ran := make(chan struct{})
+	select {
+	case n.requests <- func() { f(); close(ran) }:
+		<-ran
+		return true
+	case <-n.done:
+		return false
+	}
+}
+
+func (n *Node) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(n.cfg.Tick)
+	defer ticker.Stop()
+
+	for n.err == nil {
+		select {
+		case <-n.stop:
+			return
+		case msg := <-n.inbox:
+			n.step(msg)
+		case f := <-n.requests:
+			f()
+		case in := <-n.outputs:
+			n.unsent = append(n.unsent, in)
+		case <-ticker.C:
+			n.tick()
+		}
+		n.sendUnsent()
+		n.apply()
+	}
+}
+
+func (n *Node) tick() {
+	n.elapsed++
+	switch {
+	case n.role == leader:
+		if n.elapsed >= max(1, n.cfg.ElectionTicks/3) {
+			n.elapsed = 0
+			n.broadcast()
+		}
+	case n.elapsed >= n.timeout && n.isMember(n.cfg.ID):
+		n.campaign()
+	}
+}
+
+func (n *Node) resetTimer() {
+	n.elapsed = 0
+	n.timeout = n.cfg.ElectionTicks + rand.Intn(n.cfg.ElectionTicks)
+}
+
+func (n *Node) campaign() {
+	n.term++
+	n.role = candidate
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.votes = map[NodeID]bool{n.cfg.ID: true}
+	n.resetTimer()
+	if n.quorum(n.votes) {
+		n.becomeLeader()
+		return
+	}
+	for _, member := range n.members {
+		if member != n.cfg.ID {
+			n.send(Message{
+				Type:      VoteRequest,
+				To:        member,
+				LastIndex: n.lastIndex(),
+				LastTerm:  n.termAt(n.lastIndex()),
+			})
+		}
+	}
+}
+
+func (n *Node) becomeFollower(term uint64, leader NodeID) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	n.role = follower
+	n.leader = leader
+}
+
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.cfg.ID
+	n.elapsed = 0
+	n.next = make(map[NodeID]uint64)
+	n.match = make(map[NodeID]uint64)
+	for _, member := range n.members {
+		n.next[member] = n.lastIndex() + 1
+	}
+	n.appendEntry(Entry{Kind: NoopEntry})
+	n.broadcast()
+	n.runOutputs(n.initOutputs)
+}
+
+func (n *Node) propose(in gu.In) error {
+	if n.role != leader {
+		return ErrNotLeader
+	}
+	n.appendEntry(Entry{Kind: InputEntry, In: in})
+	n.broadcast()
+	return nil
+}
+
+// sendUnsent proposes the inputs sent by outputs if this node is the
+// leader, and otherwise passes them on to the leader. If the leader
+// isn't known then they are kept until it is.
+func (n *Node) sendUnsent() {
+	if len(n.unsent) == 0 {
+		return
+	}
+	switch {
+	case n.role == leader:
+		for _, in := range n.unsent {
+			n.propose(in)
+		}
+	case n.leader != "" && n.leader != n.cfg.ID:
+		entries := make([]Entry, len(n.unsent))
+		for i, in := range n.unsent {
+			entries[i] = Entry{Kind: InputEntry, In: in}
+		}
+		n.send(Message{Type: ProposeRequest, To: n.leader, Entries: entries})
+	default:
+		return
+	}
+	n.unsent = nil
+}
+
+func (n *Node) changeMembers(change func([]NodeID) []NodeID) error {
+	var err error
+	ok := n.do(func() {
+		if n.role != leader {
+			err = ErrNotLeader
+			return
+		}
+		for i := n.commit + 1; i <= n.lastIndex(); i++ {
+			if n.entry(i).Kind == ConfigEntry {
+				err = ErrChangePending
+				return
+			}
+		}
+		n.appendEntry(Entry{Kind: ConfigEntry, Members: change(n.members)})
+		n.broadcast()
+	})
+	if !ok {
+		return ErrStopped
+	}
+	return err
+}
+
+func (n *Node) appendEntry(e Entry) {
+	e.Term = n.term
+	e.Index = n.lastIndex() + 1
+	n.log = append(n.log, e)
+	n.match[n.cfg.ID] = e.Index
+	if e.Kind == ConfigEntry {
+		n.updateMembers()
+	}
+	n.advanceCommit()
+}
+
+func (n *Node) step(msg Message) {
+	if msg.Term > n.term {
+		var leader NodeID
+		if msg.Type == AppendRequest || msg.Type == SnapshotRequest {
+			leader = msg.From
+		}
+		n.becomeFollower(msg.Term, leader)
+	}
+
+	switch msg.Type {
+	case VoteRequest:
+		granted := msg.Term == n.term &&
+			(n.votedFor == "" || n.votedFor == msg.From) &&
+			n.upToDate(msg.LastIndex, msg.LastTerm)
+		if granted {
+			n.votedFor = msg.From
+			n.resetTimer()
+		}
+		n.send(Message{Type: VoteResponse, To: msg.From, Granted: granted})
+
+	case VoteResponse:
+		if n.role == candidate && msg.Term == n.term && msg.Granted {
+			n.votes[msg.From] = true
+			if n.quorum(n.votes) {
+				n.becomeLeader()
+			}
+		}
+
+	case AppendRequest, SnapshotRequest:
+		if msg.Term < n.term {
+			n.send(Message{Type: AppendResponse, To: msg.From})
+			return
+		}
+		n.becomeFollower(msg.Term, msg.From)
+		n.resetTimer()
+		if msg.Type == AppendRequest {
+			n.handleAppend(msg)
+		} else {
+			n.installSnapshot(msg.Snapshot)
+			n.send(Message{
+				Type:    AppendResponse,
+				To:      msg.From,
+				Success: true,
+				Match:   msg.Snapshot.Index,
+			})
+		}
+
+	case ProposeRequest:
+		for _, e := range msg.Entries {
+			n.unsent = append(n.unsent, e.In)
+		}
+
+	case AppendResponse:
+		if n.role != leader || msg.Term != n.term {
+			return
+		}
+		if msg.Success {
+			if msg.Match > n.match[msg.From] {
+				n.match[msg.From] = msg.Match
+			}
+			n.next[msg.From] = n.match[msg.From] + 1
+			n.advanceCommit()
+			if n.next[msg.From] <= n.lastIndex() {
+				n.sendAppend(msg.From)
+			}
+			return
+		}
+		n.next[msg.From] = max(1, min(n.next[msg.From]-1, msg.Match+1))
+		n.sendAppend(msg.From)
+	}
+}
+
+func (n *Node) handleAppend(msg Message) {
+	base := n.log[0].Index
+	entries := msg.Entries
+	if msg.PrevIndex < base {
+		// The start of the entries is already in the snapshot.
+		for len(entries) > 0 && entries[0].Index <= base {
+			entries = entries[1:]
+		}
+		msg.PrevIndex = base
+		msg.PrevTerm = n.log[0].Term
+	}
+
+	if msg.PrevIndex > n.lastIndex() || n.termAt(msg.PrevIndex) != msg.PrevTerm {
+		hint := n.lastIndex()
+		if msg.PrevIndex <= hint {
+			hint = msg.PrevIndex - 1
+		}
+		n.send(Message{Type: AppendResponse, To: msg.From, Match: hint})
+		return
+	}
+
+	changed := false
+	for _, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-base]
+		}
+		n.log = append(n.log, e)
+		changed = true
+	}
+	if changed {
+		n.updateMembers()
+	}
+
+	last := msg.PrevIndex + uint64(len(entries))
+	if msg.Commit > n.commit {
+		n.commit = min(msg.Commit, last)
+	}
+	n.send(Message{Type: AppendResponse, To: msg.From, Success: true, Match: last})
+}
+
+func (n *Node) installSnapshot(s *Snapshot) {
+	if s.Index <= n.commit {
+		return
+	}
+	if s.Index <= n.lastIndex() && n.termAt(s.Index) == s.Term {
+		n.log = n.log[s.Index-n.log[0].Index:]
+	} else {
+		n.log = []Entry{{Index: s.Index, Term: s.Term}}
+	}
+	n.snapshot = s
+	n.baseMembers = s.Members
+	n.machine = s.Machine.Clone()
+	n.commit = s.Index
+	n.applied = s.Index
+	n.updateMembers()
+}
+
+// apply applies the committed entries to the program, and runs the
+// outputs if this node is the leader and added the entry itself. The
+// outputs of entries from earlier terms were run by the leader then.
+func (n *Node) apply() {
+	for n.applied < n.commit && n.err == nil {
+		n.applied++
+		e := n.entry(n.applied)
+		switch e.Kind {
+		case InputEntry:
+			outputs := n.machine.Apply(e.In)
+			if n.role == leader && e.Term == n.term {
+				n.runOutputs(outputs)
+			}
+			n.err = n.machine.State().FatalErr()
+
+		case ConfigEntry:
+			if n.role == leader && !n.isMember(n.cfg.ID) {
+				n.becomeFollower(n.term, "")
+			}
+		}
+	}
+
+	if n.applied-n.log[0].Index >= n.cfg.SnapshotEvery {
+		n.takeSnapshot()
+	}
+}
+
+func (n *Node) runOutputs(outputs []gu.Out) {
+	for _, output := range outputs {
+		if output.Fast() {
+			output.Io(n.outputs)
+		} else {
+			go output.Io(n.outputs)
+		}
+	}
+}
+
+func (n *Node) takeSnapshot() {
+	n.snapshot = &Snapshot{
+		Index:   n.applied,
+		Term:    n.termAt(n.applied),
+		Members: n.membersAt(n.applied),
+		Machine: n.machine.Clone(),
+	}
+	n.baseMembers = n.snapshot.Members
+	n.log = append([]Entry(nil), n.log[n.applied-n.log[0].Index:]...)
+}
+
+func (n *Node) broadcast() {
+	for _, member := range n.members {
+		if member != n.cfg.ID {
+			n.sendAppend(member)
+		}
+	}
+}
+
+func (n *Node) sendAppend(to NodeID) {
+	next, ok := n.next[to]
+	if !ok {
+		next = n.lastIndex() + 1
+		n.next[to] = next
+	}
+
+	base := n.log[0].Index
+	if next <= base {
+		n.send(Message{Type: SnapshotRequest, To: to, Snapshot: n.snapshot})
+		return
+	}
+	end := min(n.lastIndex(), next+maxBatch-1)
+	n.send(Message{
+		Type:      AppendRequest,
+		To:        to,
+		PrevIndex: next - 1,
+		PrevTerm:  n.termAt(next - 1),
+		Entries:   append([]Entry(nil), n.log[next-base:end-base+1]...),
+		Commit:    n.commit,
+	})
+}
+
+func (n *Node) send(msg Message) {
+	msg.From = n.cfg.ID
+	msg.Term = n.term
+	n.cfg.Transport.Send(msg)
+}
+
+// advanceCommit commits the latest entry from this term that a
+// majority of the members have.
+func (n *Node) advanceCommit() {
+	if n.role != leader {
+		return
+	}
+	for i := n.lastIndex(); i > n.commit && n.termAt(i) == n.term; i-- {
+		have := make(map[NodeID]bool)
+		for _, member := range n.members {
+			if n.match[member] >= i {
+				have[member] = true
+			}
+		}
+		if n.quorum(have) {
+			n.commit = i
+			return
+		}
+	}
+}
+
+func (n *Node) quorum(have map[NodeID]bool) bool {
+	count := 0
+	for _, member := range n.members {
+		if have[member] {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+func (n *Node) upToDate(lastIndex, lastTerm uint64) bool {
+	ourTerm := n.termAt(n.lastIndex())
+	return lastTerm > ourTerm || lastTerm == ourTerm && lastIndex >= n.lastIndex()
+}
+
+func (n *Node) isMember(id NodeID) bool {
+	for _, member := range n.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) updateMembers() {
+	n.members = n.membersAt(n.lastIndex())
+	if n.role == leader {
+		for _, member := range n.members {
+			if _, ok := n.next[member]; !ok {
+				n.next[member] = n.lastIndex() + 1
+			}
+		}
+	}
+}
+
+// membersAt returns the members as of the latest ConfigEntry up to
+// index i.
+func (n *Node) membersAt(i uint64) []NodeID {
+	for ; i > n.log[0].Index; i-- {
+		if e := n.entry(i); e.Kind == ConfigEntry {
+			return e.Members
+		}
+	}
+	return n.baseMembers
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) entry(i uint64) Entry {
+	return n.log[i-n.log[0].Index]
+}
+
+// termAt returns the term of entry i, or 0 if it has been thrown away.
+func (n *Node) termAt(i uint64) uint64 {
+	if i < n.log[0].Index || i > n.lastIndex() {
+		return 0
+	}
+	return n.entry(i).Term
+}
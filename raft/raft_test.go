@@ -0,0 +1,294 @@
+package raft
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+// sum is a program that adds up its inputs.
+type sum struct{ total int }
+
+func (sum) Waiters() []gu.Waiter { return nil }
+func (sum) FatalErr() error      { return nil }
+
+// add is an input for sum. Adding 1000 also runs an output, which
+// adds 1 more, and adding 2000 runs one that adds 1 when it is
+// released.
+type add int
+
+func (add) Router(gu.Waiter) gu.Ready { return nil }
+
+func (a add) Update(s gu.State) (gu.State, []gu.Out) {
+	x := s.(sum)
+	x.total += int(a)
+	switch a {
+	case 1000:
+		return x, []gu.Out{addOne{}}
+	case 2000:
+		return x, []gu.Out{delayedOne{}}
+	}
+	return x, nil
+}
+
+type addOne struct{}
+
+func (addOne) Io(ch chan gu.In) { ch <- add(1) }
+func (addOne) Fast() bool       { return false }
+
+// released is closed to let a delayedOne send.
+var released chan struct{}
+
+// delayedOne is like addOne, but waits for released first.
+type delayedOne struct{}
+
+func (delayedOne) Io(ch chan gu.In) {
+	<-released
+	ch <- add(1)
+}
+
+func (delayedOne) Fast() bool { return false }
+
+// joined is an input for the Join kept by joinStart.
+type joined string
+
+func (joined) Router(gu.Waiter) gu.Ready              { return nil }
+func (joined) Update(s gu.State) (gu.State, []gu.Out) { return s, nil }
+
+func is(j joined) gu.Expect {
+	return func(in gu.In) (bool, error) { return in == j, nil }
+}
+
+type start struct{}
+
+func (start) InitState() gu.State { return sum{} }
+
+// InitOutputs keeps a Join, which adds 100 once it has x and y.
+func (start) InitOutputs() []gu.Out {
+	then := func(s gu.State, _ gu.Results, ok bool) (gu.State, []gu.Out) {
+		x := s.(sum)
+		x.total += 100
+		return x, nil
+	}
+	return []gu.Out{gu.WaitAlways("join", gu.All(then, is("x"), is("y")))}
+}
+
+type cluster struct {
+	t     *testing.T
+	net   *Network
+	nodes map[NodeID]*Node
+}
+
+func newCluster(t *testing.T, ids ...NodeID) *cluster {
+	c := &cluster{t: t, net: NewNetwork(), nodes: make(map[NodeID]*Node)}
+	for _, id := range ids {
+		c.start(id, ids)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+func (c *cluster) start(id NodeID, members []NodeID) *Node {
+	n := Start(Config{
+		ID:            id,
+		Members:       members,
+		Transport:     c.net,
+		Tick:          2 * time.Millisecond,
+		SnapshotEvery: 20,
+	}, start{})
+	c.net.Add(id, n)
+	c.nodes[id] = n
+	return n
+}
+
+// leader waits for a node other than the ones skipped to be the
+// leader, as far as it knows.
+func (c *cluster) leader(skip ...NodeID) *Node {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+	nodes:
+		for id, n := range c.nodes {
+			for _, s := range skip {
+				if id == s {
+					continue nodes
+				}
+			}
+			if n.Leader() == id {
+				return n
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.t.Fatal("no leader was elected")
+	return nil
+}
+
+func (c *cluster) propose(n *Node, ins ...gu.In) {
+	c.t.Helper()
+	for _, in := range ins {
+		if err := n.Propose(in); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+func total(n *Node) int {
+	return n.Query(func(s gu.State) interface{} { return s.(sum).total }).(int)
+}
+
+// waitTotal waits for the node to have applied inputs adding up to
+// want.
+func (c *cluster) waitTotal(n *Node, want int) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for total(n) != want {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("node %s has total %d, expected %d", n.cfg.ID, total(n), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, "a", "b", "c")
+	leader := c.leader()
+	for _, n := range c.nodes {
+		if n != leader && n.Propose(add(1)) != ErrNotLeader {
+			t.Errorf("follower %s accepted a proposal", n.cfg.ID)
+		}
+	}
+
+	c.propose(leader, add(1), add(2), add(1000))
+	for _, n := range c.nodes {
+		c.waitTotal(n, 1004)
+	}
+}
+
+func TestLeaderFailure(t *testing.T) {
+	c := newCluster(t, "a", "b", "c")
+	old := c.leader()
+	c.propose(old, add(1))
+	for _, n := range c.nodes {
+		c.waitTotal(n, 1)
+	}
+
+	c.net.Disconnect(old.cfg.ID)
+	leader := c.leader(old.cfg.ID)
+	for i := 0; i < 50; i++ {
+		c.propose(leader, add(2))
+	}
+	c.waitTotal(leader, 101)
+	if total(old) != 1 {
+		t.Errorf("disconnected node has total %d", total(old))
+	}
+
+	// The old leader catches up once it is back, from a snapshot,
+	// since the log has moved on.
+	c.net.Reconnect(old.cfg.ID)
+	c.waitTotal(old, 101)
+	if old.Leader() == old.cfg.ID {
+		t.Error("old leader didn't step down")
+	}
+}
+
+func TestOutputAfterSteppingDown(t *testing.T) {
+	released = make(chan struct{})
+	c := newCluster(t, "a", "b", "c")
+	old := c.leader()
+	c.propose(old, add(2000))
+	c.waitTotal(old, 2000)
+
+	// The old leader's output sends its input once another node
+	// has taken over, and the input is passed on to it.
+	c.net.Disconnect(old.cfg.ID)
+	leader := c.leader(old.cfg.ID)
+	c.net.Reconnect(old.cfg.ID)
+	deadline := time.Now().Add(5 * time.Second)
+	for old.Leader() != leader.cfg.ID {
+		if time.Now().After(deadline) {
+			t.Fatal("the old leader didn't learn of the new one")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(released)
+	for _, n := range c.nodes {
+		c.waitTotal(n, 2001)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	c := newCluster(t, "a")
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.nodes["a"].Stop()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMembers(t *testing.T) {
+	c := newCluster(t, "a", "b", "c")
+	leader := c.leader()
+	for i := 0; i < 50; i++ {
+		c.propose(leader, add(1))
+	}
+
+	d := c.start("d", nil)
+	if err := leader.AddNode("d"); err != nil {
+		t.Fatal(err)
+	}
+	c.waitTotal(d, 50)
+	if members := d.Members(); len(members) != 4 {
+		t.Errorf("new node has members %v", members)
+	}
+
+	if err := leader.RemoveNode("d"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(leader.Members()) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("members are %v after removing d", leader.Members())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.propose(leader, add(1))
+	for id, n := range c.nodes {
+		if id != "d" {
+			c.waitTotal(n, 51)
+		}
+	}
+}
+
+func TestSnapshotIsNotChanged(t *testing.T) {
+	c := newCluster(t, "a")
+	leader := c.leader()
+	leader.do(func() { leader.cfg.SnapshotEvery = 2 })
+	c.propose(leader, joined("x"), add(1), add(1))
+	c.waitTotal(leader, 2)
+
+	var snapshot *Snapshot
+	leader.do(func() { snapshot = leader.snapshot })
+	if snapshot == nil {
+		t.Fatal("no snapshot was taken")
+	}
+	c.propose(leader, joined("y"))
+	c.waitTotal(leader, 102)
+
+	// The Join in the snapshot is still waiting for y.
+	m := snapshot.Machine.Clone()
+	m.Apply(joined("y"))
+	if got := m.State().(sum).total; got != 102 {
+		t.Errorf("snapshot updated with y has total %d, expected 102", got)
+	}
+}
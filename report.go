@@ -0,0 +1,267 @@
+package gu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Most errors that a program meets are not fatal: a request fails and
+// is retried, or a bad message is ignored. An update can report these
+// with Report, and they are passed on to the Observers, along with the
+// input that led to them, instead of each program keeping a list of
+// errors in its state.
+
+// Report returns an instruction to the main loop to report a non-fatal
+// error, caused by the input being processed. The program carries on
+// as usual. Errors that should stop the program are returned by
+// State.FatalErr instead. A nil error is ignored.
+func Report(err error) Out {
+	return directive(func(m *machine) {
+		if err != nil {
+			m.reported = append(m.reported, err)
+		}
+	})
+}
+
+// ErrorReported is the Event for an update reporting an error. In is
+// the input that was being processed, and Waiter is the Waiter that
+// claimed it, if one did. In is nil for an error reported by the
+// initial outputs.
+type ErrorReported struct {
+	Err    error
+	In     In
+	Waiter Waiter
+	Time   time.Time
+}
+
+func (ErrorReported) event() {}
+
+// Class is a kind of error, for deciding what to do about it.
+type Class int
+
+const (
+	// Unclassified is the Class of an error that hasn't been
+	// marked with one of the others.
+	Unclassified Class = iota
+
+	// Transient is for errors that may go away if the same thing
+	// is tried again, such as a timeout.
+	Transient
+
+	// Permanent is for errors that will happen again if the same
+	// thing is tried again, such as a bad request.
+	Permanent
+
+	// Fatal is for errors that the program can't carry on after.
+	Fatal
+)
+
+func (c Class) String() string {
+	switch c {
+	case Transient:
+		return "transient"
+	case Permanent:
+		return "permanent"
+	case Fatal:
+		return "fatal"
+	}
+	return "unclassified"
+}
+
+// classified is an error marked with a Class.
+type classified struct {
+	err   error
+	class Class
+}
+
+func (c classified) Error() string {
+	return c.err.Error()
+}
+
+func (c classified) Unwrap() error {
+	return c.err
+}
+
+// MarkTransient wraps an error to mark it as Transient.
+func MarkTransient(err error) error {
+	return classified{err: err, class: Transient}
+}
+
+// MarkPermanent wraps an error to mark it as Permanent.
+func MarkPermanent(err error) error {
+	return classified{err: err, class: Permanent}
+}
+
+// MarkFatal wraps an error to mark it as Fatal.
+func MarkFatal(err error) error {
+	return classified{err: err, class: Fatal}
+}
+
+// Classify returns the Class that the error, or an error it wraps, was
+// marked with. If it was marked more than once, the outermost mark is
+// used.
+func Classify(err error) Class {
+	var c classified
+	if errors.As(err, &c) {
+		return c.class
+	}
+	return Unclassified
+}
+
+// IsTransient reports whether the error was marked as Transient.
+func IsTransient(err error) bool {
+	return Classify(err) == Transient
+}
+
+// IsPermanent reports whether the error was marked as Permanent.
+func IsPermanent(err error) bool {
+	return Classify(err) == Permanent
+}
+
+// IsFatal reports whether the error was marked as Fatal.
+func IsFatal(err error) bool {
+	return Classify(err) == Fatal
+}
+
+// ErrorSink is somewhere to send reported errors, such as a log or an
+// error tracker.
+type ErrorSink interface {
+	Send(ErrorReported)
+}
+
+// Errors is an Observer that counts reported errors by their Class,
+// and sends each one to a sink.
+type Errors struct {
+	sink ErrorSink
+
+	mu     sync.Mutex
+	counts map[Class]int
+}
+
+// NewErrors makes an Errors that sends to the sink, which can be nil
+// if only the counts are wanted.
+func NewErrors(sink ErrorSink) *Errors {
+	return &Errors{sink: sink, counts: make(map[Class]int)}
+}
+
+// Observe counts and sends on the reported errors. Other kinds of
+// Event are ignored.
+func (e *Errors) Observe(event Event) {
+	reported, ok := event.(ErrorReported)
+	if !ok {
+		return
+	}
+
+	e.mu.Lock()
+	e.counts[Classify(reported.Err)]++
+	e.mu.Unlock()
+
+	if e.sink != nil {
+		e.sink.Send(reported)
+	}
+}
+
+// Counts returns the number of errors reported so far of each Class.
+func (e *Errors) Counts() map[Class]int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	counts := make(map[Class]int, len(e.counts))
+	for class, count := range e.counts {
+		counts[class] = count
+	}
+	return counts
+}
+
+// WriteCounts writes the counts as lines of text, like "transient 3",
+// in the order of the classes.
+func (e *Errors) WriteCounts(w io.Writer) error {
+	counts := e.Counts()
+	for class := Unclassified; class <= Fatal; class++ {
+		if counts[class] == 0 {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "%s %d\n", class, counts[class])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogErrors sends reported errors to a logger.
+func LogErrors(logger *log.Logger) ErrorSink {
+	return logErrors{logger: logger}
+}
+
+type logErrors struct {
+	logger *log.Logger
+}
+
+func (s logErrors) Send(reported ErrorReported) {
+	s.logger.Printf(
+		"gu: %s error processing %s: %v: %+v",
+		Classify(reported.Err), typeName(reported.In), reported.Err, reported.In)
+}
+
+// JSONErrors writes each reported error as a line of JSON, which is
+// usually to a file, or to a pipe to an error tracker.
+func JSONErrors(w io.Writer) ErrorSink {
+	return &jsonErrors{w: w}
+}
+
+type jsonErrors struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *jsonErrors) Send(reported ErrorReported) {
+	line, err := json.Marshal(struct {
+		Error string    `json:"error"`
+		Class string    `json:"class"`
+		Type  string    `json:"type"`
+		Time  time.Time `json:"time"`
+		In    string    `json:"in"`
+	}{
+		Error: reported.Err.Error(),
+		Class: Classify(reported.Err).String(),
+		Type:  typeName(reported.In),
+		Time:  reported.Time,
+		In:    fmt.Sprintf("%+v", reported.In),
+	})
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(line, '\n'))
+}
+
+// report tells the Observers about the errors reported by the last
+// update.
+func (l *loop) report(m *machine, in In, claimed Waiter) {
+	for _, err := range m.reported {
+		l.observe(ErrorReported{
+			Err:    err,
+			In:     in,
+			Waiter: claimed,
+			Time:   time.Now(),
+		})
+	}
+}
+
+// reportInit tells the Observers about the errors reported, and the
+// rejection, in the initial outputs, which have no input.
+func (l *loop) reportInit(m *machine) {
+	if m.rejected != nil {
+		l.deadLetter(DeadLetter{Reason: m.rejected})
+	}
+	l.report(m, nil, nil)
+	m.rejected, m.reported = nil, nil
+}
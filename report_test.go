@@ -0,0 +1,101 @@
+package gu
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+// flaky is an input whose update counts it and reports errors.
+type flaky struct{}
+
+func (flaky) Router(Waiter) Ready { return nil }
+
+func (flaky) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.n++
+	return c, []Out{
+		Report(MarkTransient(errors.New("timeout"))),
+		Report(nil),
+		Report(errors.New("plain")),
+		Report(MarkPermanent(MarkTransient(errors.New("bad request")))),
+	}
+}
+
+func TestReport(t *testing.T) {
+	var logged, lines bytes.Buffer
+	counted := NewErrors(LogErrors(log.New(&logged, "", 0)))
+	p := Start(start{
+		state:     count{limit: 1},
+		outputs:   []Out{send{flaky{}}},
+		observers: []Observer{counted, NewErrors(JSONErrors(&lines))},
+	})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+
+	counts := counted.Counts()
+	if counts[Transient] != 1 || counts[Permanent] != 1 || counts[Unclassified] != 1 || len(counts) != 3 {
+		t.Errorf("counts are %v", counts)
+	}
+	var written bytes.Buffer
+	counted.WriteCounts(&written)
+	if written.String() != "unclassified 1\ntransient 1\npermanent 1\n" {
+		t.Errorf("WriteCounts wrote %q", written.String())
+	}
+	if !strings.Contains(logged.String(), "gu: transient error processing gu.flaky: timeout") {
+		t.Errorf("logged %q", logged.String())
+	}
+
+	var first struct{ Error, Class, Type string }
+	if err := json.Unmarshal(bytes.SplitN(lines.Bytes(), []byte("\n"), 2)[0], &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Error != "timeout" || first.Class != "transient" || first.Type != "gu.flaky" {
+		t.Errorf("first line is %+v", first)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	err := errors.New("x")
+	if Classify(err) != Unclassified || !IsFatal(MarkFatal(err)) || !IsTransient(MarkTransient(err)) {
+		t.Error("wrong classes")
+	}
+	wrapped := MarkPermanent(MarkTransient(err))
+	if !IsPermanent(wrapped) || !errors.Is(wrapped, err) {
+		t.Errorf("outermost mark isn't used: %s", Classify(wrapped))
+	}
+}
+
+// initErrors is an Init whose initial outputs report an error and
+// reject.
+type initErrors struct{ start }
+
+func (initErrors) InitOutputs() []Out {
+	return []Out{Report(errors.New("no config")), Reject(errors.New("nothing to do"))}
+}
+
+func TestReportInit(t *testing.T) {
+	r := &recorder{}
+	counted := NewErrors(JSONErrors(&bytes.Buffer{}))
+	p := Start(initErrors{start{state: count{}, observers: []Observer{r, counted}}})
+	p.Stop()
+	if err := wait(t, p); err != nil {
+		t.Fatal(err)
+	}
+
+	reported := find[ErrorReported](r)
+	if len(reported) != 1 || reported[0].Err.Error() != "no config" || reported[0].In != nil {
+		t.Errorf("reported %+v", reported)
+	}
+	letters := find[DeadLetter](r)
+	if len(letters) != 1 || letters[0].Reason.Error() != "nothing to do" {
+		t.Errorf("dead letters are %+v", letters)
+	}
+	if counted.Counts()[Unclassified] != 1 {
+		t.Errorf("counts are %v", counted.Counts())
+	}
+}
@@ -0,0 +1,290 @@
+package gu
+
+import (
+	"reflect"
+	"slices"
+	"time"
+	"unsafe"
+)
+
+// A new version of a program's pure logic can be tried out in shadow
+// before it is deployed. The main loop gives each input to both the
+// current version and the candidate, but only runs the outputs of the
+// current one. Whenever the two versions return different outputs,
+// keep different Waiters, reject or report different errors, or end
+// up in different states, the Observers are told.
+
+// Shadowed is an optional interface for Init, which gives the Init of
+// the candidate version to run in shadow. The candidate starts from
+// its own InitState, so it should be shadowing the program from the
+// start. Its fatal errors, dead letters and reported errors are
+// ignored, and it doesn't see inputs dropped by the Inbox.
+type Shadowed interface {
+	Shadow() Init
+}
+
+// Fingerprinted is an optional interface for State and Out, which is
+// used to compare the current and candidate versions. Values that are
+// the same as far as the program is concerned should have the same
+// fingerprint. Without it, or if only one of the two values has it,
+// values are compared field by field, following pointers, with
+// functions and channels counted as the same if they have the same
+// type. That needs the two versions to use the same types, so a
+// candidate that uses new types needs Fingerprint, and it may be slow
+// for a large state.
+type Fingerprinted interface {
+	Fingerprint() string
+}
+
+// Divergence is the Event for the candidate version differing from the
+// current one. In is the input they were given, or nil for the
+// initial state and outputs.
+type Divergence struct {
+	In In
+
+	// Outputs are the outputs returned by each version, and
+	// States describe their new states, with their fingerprints if
+	// they are Fingerprinted.
+	Outputs       []Out
+	ShadowOutputs []Out
+	State         string
+	ShadowState   string
+
+	// Kept describe the Waiters kept by the main loop for each
+	// version, by their types and keys, and Errors describe the
+	// rejection and the errors reported by the update.
+	Kept         []string
+	ShadowKept   []string
+	Errors       []string
+	ShadowErrors []string
+
+	// Panic is set if the candidate's update panicked, in which case
+	// it is no longer run.
+	Panic interface{}
+
+	Time time.Time
+}
+
+func (Divergence) event() {}
+
+// shadow is the candidate version of the program.
+type shadow struct {
+	machine *machine
+
+	// outputs are the candidate's initial outputs, until they have
+	// been compared.
+	outputs []Out
+}
+
+func newShadow(candidate Init) *shadow {
+	m := &machine{state: candidate.InitState()}
+	return &shadow{machine: m, outputs: m.direct(candidate.InitOutputs())}
+}
+
+// compareInit compares the initial states and outputs of the two
+// versions.
+func (l *loop) compareInit(m *machine, outputs []Out) {
+	if l.shadow == nil {
+		return
+	}
+	l.compare(nil, m, outputs, l.shadow.outputs)
+	l.shadow.outputs = nil
+}
+
+// runShadow gives the input to the candidate, and compares the result
+// with the current version's.
+func (l *loop) runShadow(in In, m *machine, outputs []Out) {
+	if l.shadow == nil {
+		return
+	}
+
+	shadowOutputs, panicked := l.shadow.update(in)
+	if panicked != nil {
+		l.observe(Divergence{
+			In:      in,
+			Outputs: outputs,
+			State:   fingerprint(m.state),
+			Kept:    describeKept(m),
+			Errors:  describeErrors(m),
+			Panic:   panicked,
+			Time:    time.Now(),
+		})
+		l.shadow = nil
+		return
+	}
+	l.compare(in, m, outputs, shadowOutputs)
+}
+
+// update runs the candidate's update, and returns what it panicked
+// with if it did.
+func (s *shadow) update(in In) (outputs []Out, panicked interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = r
+		}
+	}()
+	outputs, _ = s.machine.update(in)
+	return outputs, nil
+}
+
+// compare compares the two versions after a transition. The outputs
+// have had their directives taken out, so the Waiters kept by the main
+// loop and the errors are compared too.
+func (l *loop) compare(in In, m *machine, outputs, shadowOutputs []Out) {
+	sm := l.shadow.machine
+	kept, shadowKept := describeKept(m), describeKept(sm)
+	errs, shadowErrs := describeErrors(m), describeErrors(sm)
+	if same(m.state, sm.state) &&
+		sameOutputs(outputs, shadowOutputs) &&
+		slices.Equal(kept, shadowKept) &&
+		slices.Equal(errs, shadowErrs) {
+		return
+	}
+	l.observe(Divergence{
+		In:            in,
+		Outputs:       outputs,
+		ShadowOutputs: shadowOutputs,
+		State:         fingerprint(m.state),
+		ShadowState:   fingerprint(sm.state),
+		Kept:          kept,
+		ShadowKept:    shadowKept,
+		Errors:        errs,
+		ShadowErrors:  shadowErrs,
+		Time:          time.Now(),
+	})
+}
+
+// describeKept describes the Waiters kept by the main loop, like
+// "once main.reading" or "always ticks main.ticker".
+func describeKept(m *machine) []string {
+	var kept []string
+	for _, k := range m.waiters {
+		if k.once {
+			kept = append(kept, "once "+typeName(k.waiter))
+		} else {
+			kept = append(kept, "always "+k.key+" "+typeName(k.waiter))
+		}
+	}
+	return kept
+}
+
+// describeErrors describes the rejection and the errors reported by
+// the last update.
+func describeErrors(m *machine) []string {
+	var errs []string
+	if m.rejected != nil {
+		errs = append(errs, "rejected: "+m.rejected.Error())
+	}
+	for _, err := range m.reported {
+		errs = append(errs, "reported: "+err.Error())
+	}
+	return errs
+}
+
+func sameOutputs(a, b []Out) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !same(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// same compares a value from each version, by their fingerprints if
+// they both have them, and otherwise field by field.
+func same(a, b interface{}) bool {
+	fa, okA := a.(Fingerprinted)
+	fb, okB := b.(Fingerprinted)
+	if okA && okB {
+		return fa.Fingerprint() == fb.Fingerprint()
+	}
+	return deepEqual(reflect.ValueOf(a), reflect.ValueOf(b), make(map[visit]bool))
+}
+
+// fingerprint describes a value for a Divergence.
+func fingerprint(v interface{}) string {
+	if fingerprinted, ok := v.(Fingerprinted); ok {
+		return fingerprinted.Fingerprint()
+	}
+	return boundedText(v, maxStateText)
+}
+
+// visit is a pair of pointers being compared by deepEqual, so that it
+// doesn't go round a cycle for ever.
+type visit struct {
+	a, b unsafe.Pointer
+	typ  reflect.Type
+}
+
+// deepEqual is like reflect.DeepEqual, except that functions and
+// channels are equal if they have the same type, since the two
+// versions never share them, and a nil slice or map is equal to an
+// empty one.
+func deepEqual(a, b reflect.Value, visited map[visit]bool) bool {
+	if !a.IsValid() || !b.IsValid() {
+		return a.IsValid() == b.IsValid()
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a.Kind() {
+	case reflect.Func, reflect.Chan:
+		return true
+
+	case reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.UnsafePointer() == b.UnsafePointer() {
+			return true
+		}
+		v := visit{a: a.UnsafePointer(), b: b.UnsafePointer(), typ: a.Type()}
+		if visited[v] {
+			return true
+		}
+		visited[v] = true
+		return deepEqual(a.Elem(), b.Elem(), visited)
+
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return deepEqual(a.Elem(), b.Elem(), visited)
+
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !deepEqual(a.Field(i), b.Field(i), visited) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !deepEqual(a.Index(i), b.Index(i), visited) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for iter := a.MapRange(); iter.Next(); {
+			value := b.MapIndex(iter.Key())
+			if !value.IsValid() || !deepEqual(iter.Value(), value, visited) {
+				return false
+			}
+		}
+		return true
+	}
+	return a.Equal(b)
+}
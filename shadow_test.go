@@ -0,0 +1,197 @@
+package gu
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/8n8/gu/immutable"
+)
+
+// ledger is a State with the kinds of value that hold pointers and
+// functions.
+type ledger struct {
+	totals immutable.Map[string, int]
+	sorted immutable.SortedMap[string, int]
+	log    immutable.Vector[string]
+	join   *Join
+	n      int
+}
+
+func (ledger) Waiters() []Waiter { return nil }
+func (ledger) FatalErr() error   { return nil }
+
+// entry is an input for a ledger, which also returns outputs holding
+// functions.
+type entry struct {
+	key    string
+	amount int
+}
+
+func (entry) Router(Waiter) Ready { return nil }
+
+func (e entry) Update(s State) (State, []Out) {
+	l := s.(ledger)
+	total, _ := l.totals.Get(e.key)
+	l.totals = l.totals.Set(e.key, total+e.amount)
+	l.sorted = l.sorted.Set(e.key, total+e.amount)
+	l.log = l.log.Append(e.key)
+	l.n++
+	return l, []Out{
+		Compute(func() In { return word("computed") }),
+		Plan(finishPlan, sendJob("a", word("a"))),
+	}
+}
+
+// miscount is like entry, but the candidate version, which has no
+// Join, counts it twice. Once the states differ, each later input
+// leads to a Divergence too.
+type miscount struct{ entry }
+
+func (m miscount) Update(s State) (State, []Out) {
+	s, outputs := m.entry.Update(s)
+	l := s.(ledger)
+	if l.join == nil {
+		l.n++
+	}
+	return l, outputs
+}
+
+type ledgerStart struct {
+	start
+	candidate Init
+}
+
+func (l ledgerStart) Shadow() Init { return l.candidate }
+
+// candidate is a version of ledgerStart with no Join, so that it
+// miscounts.
+type candidate struct{}
+
+func (candidate) InitState() State   { return ledger{} }
+func (candidate) InitOutputs() []Out { return nil }
+
+func runShadowed(t *testing.T, cand Init, ins ...In) []Divergence {
+	t.Helper()
+	then := func(s State, _ Results, _ bool) (State, []Out) { return s, nil }
+	r := &recorder{}
+	p := Start(ledgerStart{
+		start: start{
+			state:     ledger{join: All(then, is("x"))},
+			observers: []Observer{r},
+		},
+		candidate: cand,
+	})
+	for _, in := range ins {
+		p.Send(in)
+	}
+	for len(find[Transition](r)) < len(ins) {
+		select {
+		case <-p.Done():
+			t.Fatalf("program stopped: %v", p.Wait())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	p.Stop()
+	wait(t, p)
+	return find[Divergence](r)
+}
+
+// twin is a candidate identical to the current version.
+type twin struct{}
+
+func (twin) InitState() State {
+	then := func(s State, _ Results, _ bool) (State, []Out) { return s, nil }
+	return ledger{join: All(then, is("x"))}
+}
+
+func (twin) InitOutputs() []Out { return nil }
+
+func TestShadowSame(t *testing.T) {
+	divergences := runShadowed(t, twin{}, entry{"a", 1}, entry{"b", 2}, entry{"a", 3})
+	if len(divergences) != 0 {
+		t.Errorf("identical versions diverged: %+v", divergences[0])
+	}
+}
+
+func TestShadowDiverges(t *testing.T) {
+	divergences := runShadowed(t, candidate{}, miscount{entry{"a", 1}})
+	if len(divergences) < 2 {
+		t.Fatalf("got %d divergences, expected at least 2", len(divergences))
+	}
+	if divergences[0].In != nil {
+		t.Errorf("first divergence is for %v, expected the initial state", divergences[0].In)
+	}
+	if divergences[1].In != (miscount{entry{"a", 1}}) || divergences[1].State == divergences[1].ShadowState {
+		t.Errorf("second divergence is %+v", divergences[1])
+	}
+}
+
+// explode is an input whose update panics in the candidate, which has
+// no Join.
+type explode struct{}
+
+func (explode) Router(Waiter) Ready { return nil }
+
+func (explode) Update(s State) (State, []Out) {
+	if s.(ledger).join == nil {
+		panic("candidate broke")
+	}
+	return s, nil
+}
+
+// directed is a candidate like twin, which also keeps a Waiter and
+// reports an error in its initial outputs.
+type directed struct{ twin }
+
+func (directed) InitOutputs() []Out {
+	return []Out{WaitAlways("k", ticket{"k"}), Report(errors.New("candidate"))}
+}
+
+func TestShadowDirectives(t *testing.T) {
+	divergences := runShadowed(t, directed{}, entry{"a", 1})
+	if len(divergences) < 2 {
+		t.Fatalf("divergences are %+v", divergences)
+	}
+	first := divergences[0]
+	if first.In != nil || first.State != first.ShadowState || len(first.Kept) != 0 || len(first.Errors) != 0 {
+		t.Errorf("first divergence is %+v", first)
+	}
+	if !slices.Equal(first.ShadowKept, []string{"always k gu.ticket"}) ||
+		!slices.Equal(first.ShadowErrors, []string{"reported: candidate"}) {
+		t.Errorf("candidate kept %v and had errors %v", first.ShadowKept, first.ShadowErrors)
+	}
+
+	// The kept Waiter still differs after the input, but the
+	// errors were only for the initial outputs.
+	second := divergences[1]
+	if len(second.ShadowKept) != 1 || len(second.ShadowErrors) != 0 {
+		t.Errorf("second divergence is %+v", second)
+	}
+}
+
+func TestShadowPanic(t *testing.T) {
+	divergences := runShadowed(t, candidate{}, explode{}, entry{"a", 1})
+	if len(divergences) != 2 || divergences[1].Panic != "candidate broke" {
+		t.Fatalf("divergences are %+v", divergences)
+	}
+}
+
+func TestDeepEqual(t *testing.T) {
+	type cycle struct {
+		next *cycle
+		f    func()
+	}
+	a, b := &cycle{f: func() {}}, &cycle{f: func() {}}
+	a.next, b.next = a, b
+	if !same(a, b) {
+		t.Error("equal cycles with different funcs differ")
+	}
+	if !same([]int(nil), []int{}) || !same(map[string]int{"a": 1}, map[string]int{"a": 1}) {
+		t.Error("equal slices or maps differ")
+	}
+	if same(map[string]int{"a": 1}, map[string]int{"a": 2}) || same(word("a"), num(1)) {
+		t.Error("different values are the same")
+	}
+}
@@ -0,0 +1,206 @@
+//go:build unix
+
+package standby
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+// Leadership is whether the process is the leader, as told to the
+// program by an Election. Err is why the process isn't the leader, if
+// it is because of an error.
+type Leadership struct {
+	Leader bool
+	Err    error
+}
+
+// ErrLockLost is the Err of a Leadership when the lock file was
+// deleted or replaced while it was locked, so that another process
+// could lock the new one.
+var ErrLockLost = errors.New("standby: lock file was deleted or replaced")
+
+// Election decides which of the processes on a host is the leader,
+// by which one holds the lock on a file. Unlike Primary and Follow it
+// doesn't copy the state, so each process runs its own program, and
+// the pure code decides which outputs to return only while it is the
+// leader.
+//
+// Its outputs tell the program about changes of leadership with the
+// input made by the function given to NewElection. An Election should
+// be made once, in Init, and kept in the state. It is also an
+// Observer, and should be one of the program's Observers, so that
+// the lock is released when the program stops.
+type Election struct {
+	path   string
+	poll   time.Duration
+	notify func(Leadership) gu.In
+
+	// stopped is closed when the program stops, so that the
+	// campaign doesn't wait for ever to send it an input.
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	mu sync.Mutex
+
+	// resign is closed to end the running campaign, or nil if
+	// there isn't one.
+	resign chan struct{}
+}
+
+// NewElection makes an Election on the lock file at path. It checks
+// whether the lock is free, or whether it still holds it, every poll.
+func NewElection(path string, poll time.Duration, notify func(Leadership) gu.In) *Election {
+	return &Election{
+		path:    path,
+		poll:    poll,
+		notify:  notify,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Observe ends the running campaign when the program stops, and
+// stops any more from starting. Other kinds of Event are ignored.
+func (e *Election) Observe(event gu.Event) {
+	if _, ok := event.(gu.Stopped); ok {
+		e.stopOnce.Do(func() { close(e.stopped) })
+	}
+}
+
+// Campaign returns an output that waits for the lock and then sends
+// Leadership{Leader: true}. It keeps the lock until the process ends
+// or Resign is run, or until the lock file is deleted or replaced by
+// another one, and then sends Leadership{Leader: false}. If the
+// program wants to be the leader again after that, it has to return
+// Campaign again. A Campaign run while another one is still running
+// does nothing.
+func (e *Election) Campaign() gu.Out {
+	return campaign{e}
+}
+
+// Resign returns an output that ends the running campaign. If the
+// process is the leader then the lock is released.
+func (e *Election) Resign() gu.Out {
+	return resign{e}
+}
+
+type campaign struct {
+	e *Election
+}
+
+func (c campaign) Io(ch chan gu.In) {
+	e := c.e
+	select {
+	case <-e.stopped:
+		return
+	default:
+	}
+	e.mu.Lock()
+	if e.resign != nil {
+		e.mu.Unlock()
+		return
+	}
+	resign := make(chan struct{})
+	e.resign = resign
+	e.mu.Unlock()
+
+	lost := e.campaign(ch, resign)
+
+	// The campaign is cleared before the program is told, so that
+	// it can start another one straight away.
+	e.mu.Lock()
+	if e.resign == resign {
+		e.resign = nil
+	}
+	e.mu.Unlock()
+	e.send(ch, lost)
+}
+
+func (campaign) Fast() bool {
+	return false
+}
+
+// campaign waits for the lock, and tells the program once it has
+// it. It returns once the lock has been lost, or the campaign was
+// ended or the program stopped before it got it.
+func (e *Election) campaign(ch chan gu.In, resign chan struct{}) Leadership {
+	ticker := time.NewTicker(e.poll)
+	defer ticker.Stop()
+
+	for {
+		lock, err := TryAcquire(e.path)
+		if err != nil {
+			return Leadership{Err: err}
+		}
+		if lock != nil {
+			defer lock.Release()
+			if !e.send(ch, Leadership{Leader: true}) {
+				return Leadership{}
+			}
+			return e.hold(lock, resign, ticker.C)
+		}
+
+		select {
+		case <-resign:
+			return Leadership{}
+		case <-e.stopped:
+			return Leadership{}
+		case <-ticker.C:
+		}
+	}
+}
+
+// send tells the program about a change of leadership. It returns
+// false if the program stops first.
+func (e *Election) send(ch chan gu.In, leadership Leadership) bool {
+	select {
+	case ch <- e.notify(leadership):
+		return true
+	case <-e.stopped:
+		return false
+	}
+}
+
+// hold keeps the lock until the campaign is ended, the program stops
+// or the lock file is no longer the one that is locked.
+func (e *Election) hold(lock *Lock, resign chan struct{}, tick <-chan time.Time) Leadership {
+	for {
+		select {
+		case <-resign:
+			return Leadership{}
+		case <-e.stopped:
+			return Leadership{}
+		case <-tick:
+		}
+
+		locked, err := lock.file.Stat()
+		if err != nil {
+			return Leadership{Err: err}
+		}
+		current, err := os.Stat(e.path)
+		if err != nil || !os.SameFile(locked, current) {
+			return Leadership{Err: ErrLockLost}
+		}
+	}
+}
+
+type resign struct {
+	e *Election
+}
+
+func (r resign) Io(chan gu.In) {
+	r.e.mu.Lock()
+	defer r.e.mu.Unlock()
+	if r.e.resign != nil {
+		close(r.e.resign)
+		r.e.resign = nil
+	}
+}
+
+func (resign) Fast() bool {
+	return true
+}
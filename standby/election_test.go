@@ -0,0 +1,150 @@
+//go:build unix
+
+package standby
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+// lead is the input an Election sends in the tests.
+type lead struct{ Leadership }
+
+func (lead) Router(gu.Waiter) gu.Ready              { return nil }
+func (lead) Update(s gu.State) (gu.State, []gu.Out) { return s, nil }
+
+func newLead(l Leadership) gu.In { return lead{l} }
+
+// next returns the next Leadership sent on ch.
+func next(t *testing.T, ch chan gu.In) Leadership {
+	t.Helper()
+	select {
+	case in := <-ch:
+		return in.(lead).Leadership
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change of leadership")
+		return Leadership{}
+	}
+}
+
+// quiet fails the test if anything is sent on ch for a while.
+func quiet(t *testing.T, ch chan gu.In) {
+	t.Helper()
+	select {
+	case in := <-ch:
+		t.Fatalf("unexpected %+v", in)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestElection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	a := NewElection(path, time.Millisecond, newLead)
+	b := NewElection(path, time.Millisecond, newLead)
+	cha, chb := make(chan gu.In, 4), make(chan gu.In, 4)
+
+	go a.Campaign().Io(cha)
+	if l := next(t, cha); !l.Leader {
+		t.Fatalf("a got %+v", l)
+	}
+	go b.Campaign().Io(chb)
+	a.Campaign().Io(cha)
+	quiet(t, chb)
+
+	a.Resign().Io(cha)
+	if l := next(t, cha); l.Leader || l.Err != nil {
+		t.Fatalf("a got %+v after resigning", l)
+	}
+	if l := next(t, chb); !l.Leader {
+		t.Fatalf("b got %+v", l)
+	}
+
+	os.Remove(path)
+	if l := next(t, chb); l.Leader || l.Err != ErrLockLost {
+		t.Fatalf("b got %+v after the lock file was removed", l)
+	}
+}
+
+func TestElectionProgramStopped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	e := NewElection(path, time.Millisecond, newLead)
+
+	// Nothing reads from the chan, as if the program had stopped.
+	returned := make(chan struct{})
+	go func() {
+		e.Campaign().Io(make(chan gu.In))
+		close(returned)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	e.Observe(gu.Stopped{})
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("campaign didn't end when the program stopped")
+	}
+	lock, err := TryAcquire(path)
+	if err != nil || lock == nil {
+		t.Fatalf("lock wasn't released: %v", err)
+	}
+	lock.Release()
+}
+
+// envElectionPath tells the test binary to run TestElectionChild.
+const envElectionPath = "GU_TEST_ELECTION_PATH"
+
+// TestElectionChild is run in another process by
+// TestElectionProcesses. It campaigns, and writes a line once it is
+// the leader.
+func TestElectionChild(t *testing.T) {
+	path := os.Getenv(envElectionPath)
+	if path == "" {
+		t.Skip("only run by TestElectionProcesses")
+	}
+	e := NewElection(path, time.Millisecond, newLead)
+	ch := make(chan gu.In, 1)
+	go e.Campaign().Io(ch)
+	if l := next(t, ch); !l.Leader {
+		t.Fatalf("got %+v", l)
+	}
+	os.Stdout.WriteString("leader\n")
+	select {}
+}
+
+func TestElectionProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestElectionChild$")
+	cmd.Env = append(os.Environ(), envElectionPath+"="+path)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil || line != "leader\n" {
+		t.Fatalf("child wrote %q: %v", line, err)
+	}
+
+	e := NewElection(path, time.Millisecond, newLead)
+	ch := make(chan gu.In, 4)
+	go e.Campaign().Io(ch)
+	defer e.Observe(gu.Stopped{})
+	quiet(t, ch)
+
+	// The lock is released when the leader dies.
+	cmd.Process.Kill()
+	cmd.Wait()
+	if l := next(t, ch); !l.Leader {
+		t.Fatalf("got %+v after the leader died", l)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package standby
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Lock is a lock on a file, held by the process that is the primary.
+// It uses flock, so it is released by the operating system if the
+// process dies, and it only works between processes that share a
+// file system that supports it.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire waits until it can lock the file at path, creating it if
+// needed.
+func Acquire(path string) (*Lock, error) {
+	return lock(path, syscall.LOCK_EX)
+}
+
+// TryAcquire locks the file at path if no other process has it
+// locked. It returns a nil Lock and nil error if one does.
+func TryAcquire(path string) (*Lock, error) {
+	l, err := lock(path, syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, nil
+	}
+	return l, err
+}
+
+func lock(path string, how int) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), how)
+	for err == syscall.EINTR {
+		err = syscall.Flock(int(file.Fd()), how)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release unlocks the file.
+func (l *Lock) Release() error {
+	return l.file.Close()
+}
@@ -0,0 +1,243 @@
+//go:build unix
+
+/*
+Package standby runs a gu program with a warm standby, which takes
+over if the primary process stops.
+
+The primary and the standby share a directory holding a lock file and
+a journal of the program's inputs. The primary holds the lock while it
+runs, and writes each input to the journal with a gu.Journal. The
+standby reads the journal as it grows and applies each input to its
+own copy of the state, without running any outputs. Once the lock is
+released, because the primary stopped or died, the standby takes it,
+reads the rest of the journal and is promoted. It then runs the main
+loop from where the primary left off, starting with the initial
+outputs, and writes to the journal in turn, so another standby can
+follow it.
+
+Outputs that the primary had not finished running are lost, so a
+program that needs them to happen should retry them from its initial
+outputs. The journal is never trimmed.
+
+For processes that each keep their own state, an Election uses the
+same kind of lock to tell the program whether it is the leader.
+*/
+package standby
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+const (
+	lockFile    = "lock"
+	journalFile = "journal"
+)
+
+// ErrStopped is returned by Standby.Program if the standby was
+// stopped before it was promoted.
+var ErrStopped = errors.New("standby: stopped")
+
+// Standby follows the journal of a primary and takes over from it.
+type Standby struct {
+	dir     string
+	init    gu.Init
+	poll    time.Duration
+	outputs []gu.Out
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu      sync.Mutex
+	machine *gu.Machine
+	program *gu.Program
+
+	// err is set before done is closed.
+	err error
+}
+
+// Primary waits for the lock in dir and then starts the program. If
+// the journal in dir already has inputs in it, from an earlier
+// primary, the state is rebuilt from them first. The lock is released
+// when the main loop ends.
+func Primary(dir string, init gu.Init) (*gu.Program, error) {
+	lock, err := Acquire(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+
+	s := newStandby(dir, init, 0)
+	reader, err := s.openJournal()
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	err = s.promote(lock, reader)
+	if err != nil {
+		return nil, err
+	}
+	return s.program, nil
+}
+
+// Follow starts a standby for the primary using dir. It checks for
+// new inputs in the journal, and whether the lock has been released,
+// every poll.
+func Follow(dir string, init gu.Init, poll time.Duration) *Standby {
+	s := newStandby(dir, init, poll)
+	go s.run()
+	return s
+}
+
+func newStandby(dir string, init gu.Init, poll time.Duration) *Standby {
+	machine, outputs := gu.NewMachine(init)
+	return &Standby{
+		dir:     dir,
+		init:    init,
+		poll:    poll,
+		outputs: outputs,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		machine: machine,
+	}
+}
+
+// Program waits until the standby has been promoted, and returns the
+// handle on its main loop. It returns an error if the standby stopped
+// first, because of Stop or because it couldn't read the journal.
+func (s *Standby) Program() (*gu.Program, error) {
+	<-s.done
+	return s.program, s.err
+}
+
+// Done returns a channel that is closed once the standby has been
+// promoted or has stopped.
+func (s *Standby) Done() <-chan struct{} {
+	return s.done
+}
+
+// Query runs a pure function on the state of the program, which may
+// be behind the primary. Once the standby has been promoted it is the
+// same as Program.Query.
+func (s *Standby) Query(ask gu.Query) interface{} {
+	s.mu.Lock()
+	program := s.program
+	if program == nil {
+		defer s.mu.Unlock()
+		return ask(s.machine.State())
+	}
+	s.mu.Unlock()
+	return program.Query(ask)
+}
+
+// Stop stops the standby following the journal, unless it has already
+// been promoted, and waits for it to stop. It doesn't stop a promoted
+// program, so use Program.Stop for that.
+func (s *Standby) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+func (s *Standby) run() {
+	defer close(s.done)
+	reader, err := s.openJournal()
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	for {
+		err := s.catchUp(reader)
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		lock, err := TryAcquire(filepath.Join(s.dir, lockFile))
+		if err != nil {
+			s.err = err
+			return
+		}
+		if lock != nil {
+			s.err = s.promote(lock, reader)
+			return
+		}
+
+		select {
+		case <-s.stop:
+			s.err = ErrStopped
+			return
+		case <-time.After(s.poll):
+		}
+	}
+}
+
+// journal is the journal file, opened for reading.
+type journal struct {
+	*os.File
+	*gu.JournalReader
+}
+
+func (s *Standby) openJournal() (journal, error) {
+	path := filepath.Join(s.dir, journalFile)
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return journal{}, err
+	}
+	return journal{File: file, JournalReader: gu.NewJournalReader(file)}, nil
+}
+
+// catchUp applies the inputs that have been added to the journal
+// since it was last called.
+func (s *Standby) catchUp(reader journal) error {
+	for {
+		in, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.machine.Apply(in)
+		s.mu.Unlock()
+	}
+}
+
+// promote reads the rest of the journal and starts the main loop. A
+// record that the old primary had only partly written is cut off the
+// end of the journal, so that the new one can add to it.
+func (s *Standby) promote(lock *Lock, reader journal) error {
+	err := s.catchUp(reader)
+	reader.File.Close()
+	path := filepath.Join(s.dir, journalFile)
+	if err == nil {
+		err = os.Truncate(path, reader.Offset())
+	}
+	var writer *gu.Journal
+	if err == nil {
+		writer, err = gu.OpenJournal(path)
+	}
+	if err != nil {
+		lock.Release()
+		return err
+	}
+
+	s.mu.Lock()
+	s.program = s.machine.Start(s.init, s.outputs, writer)
+	s.mu.Unlock()
+
+	go func() {
+		<-s.program.Done()
+		writer.Close()
+		lock.Release()
+	}()
+	return nil
+}
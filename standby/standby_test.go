@@ -0,0 +1,115 @@
+//go:build unix
+
+package standby
+
+import (
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/8n8/gu"
+)
+
+// total is a State that sums the numbers it is given.
+type total struct{ Sum int }
+
+func (total) Waiters() []gu.Waiter { return nil }
+func (total) FatalErr() error      { return nil }
+
+// Add is an input that adds to the total. It is exported so that gob
+// can write it to the journal.
+type Add int
+
+func (Add) Router(gu.Waiter) gu.Ready { return nil }
+
+func (a Add) Update(s gu.State) (gu.State, []gu.Out) {
+	t := s.(total)
+	t.Sum += int(a)
+	return t, nil
+}
+
+type zero struct{}
+
+func (zero) InitState() gu.State   { return total{} }
+func (zero) InitOutputs() []gu.Out { return nil }
+
+func init() {
+	gob.Register(Add(0))
+}
+
+func sum(q interface{ Query(gu.Query) interface{} }) int {
+	return q.Query(func(s gu.State) interface{} { return s.(total).Sum }).(int)
+}
+
+// reaches polls the sum until it is n.
+func reaches(t *testing.T, q interface{ Query(gu.Query) interface{} }, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for sum(q) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("sum is %d, expected %d", sum(q), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := Primary(dir, zero{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Follow(dir, zero{}, time.Millisecond)
+	for i := 1; i <= 100; i++ {
+		primary.Send(Add(i))
+	}
+	reaches(t, s, 5050)
+	select {
+	case <-s.Done():
+		t.Fatal("the standby took over while the primary was running")
+	default:
+	}
+
+	// The standby takes over once the primary stops.
+	primary.Stop()
+	if err := primary.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	promoted, err := s.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	promoted.Send(Add(1))
+	reaches(t, promoted, 5051)
+	promoted.Stop()
+	if err := promoted.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new primary rebuilds the state from the journal, including
+	// what the promoted standby added to it.
+	restarted, err := Primary(dir, zero{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := sum(restarted); n != 5051 {
+		t.Errorf("restarted with %d", n)
+	}
+	restarted.Stop()
+	restarted.Wait()
+}
+
+func TestStopStandby(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := Primary(dir, zero{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Stop()
+
+	s := Follow(dir, zero{}, time.Millisecond)
+	s.Stop()
+	if _, err := s.Program(); err != ErrStopped {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package gu
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanContext identifies a span in a distributed trace, as in the
+// W3C Trace Context standard. The zero value is not a valid span,
+// and means that there is no span.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// TracedIn is an optional interface for In. It is for inputs that
+// carry a trace from outside the program, for example an HTTP
+// request with a traceparent header. The transition for the input is
+// made a child of the remote span.
+type TracedIn interface {
+	// Traceparent returns the W3C traceparent header that came
+	// with the input, or "" if there wasn't one.
+	Traceparent() string
+}
+
+// TracedOut is an optional interface for Out. When the program is
+// observed, TracedIo is run instead of Io, and is given the span of
+// the output so it can pass it on, for example with
+// SetTraceparent in the HTTP requests it makes.
+type TracedOut interface {
+	TracedIo(chan In, SpanContext)
+}
+
+// TraceparentHeader is the name of the W3C Trace Context HTTP header.
+const TraceparentHeader = "traceparent"
+
+// IsValid reports whether c identifies a span.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// Traceparent formats c as a W3C traceparent header, like
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func (c SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" +
+		hex.EncodeToString(c.SpanID[:]) + "-01"
+}
+
+// ParseTraceparent reads a W3C traceparent header.
+func ParseTraceparent(header string) (SpanContext, error) {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return c, errors.New("gu: bad traceparent: " + header)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return c, errors.New("gu: bad traceparent: " + header)
+	}
+	ok := decodeHex(c.TraceID[:], parts[1]) &&
+		decodeHex(c.SpanID[:], parts[2]) &&
+		len(parts[3]) == 2
+	if !ok || !c.IsValid() {
+		return SpanContext{}, errors.New("gu: bad traceparent: " + header)
+	}
+	return c, nil
+}
+
+// SetTraceparent puts the traceparent header for c into h, so that
+// the receiver of an HTTP request can continue the trace.
+func SetTraceparent(h http.Header, c SpanContext) {
+	if c.IsValid() {
+		h.Set(TraceparentHeader, c.Traceparent())
+	}
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// newChild makes a new span in the same trace as c, or in a new
+// trace if c isn't valid.
+func (c SpanContext) newChild() SpanContext {
+	child := c
+	if !c.IsValid() {
+		rand.Read(child.TraceID[:])
+	}
+	rand.Read(child.SpanID[:])
+	return child
+}
+
+// Span is a finished piece of work in a trace: a transition, the run
+// of an output's Io, or a Waiter that has waited too long.
+type Span struct {
+	// Name is "transition", "output" or "waiter aged" followed by
+	// a type, like "transition main.fileRead".
+	Name string
+
+	Context SpanContext
+
+	// Parent is the zero SpanContext for the root of a trace.
+	Parent SpanContext
+
+	Start time.Time
+	End   time.Time
+
+	// Attributes give more detail about the span, such as the type
+	// of the Waiter that claimed an input.
+	Attributes map[string]string
+}
+
+// MarshalJSON writes the span with its IDs in hex.
+func (s Span) MarshalJSON() ([]byte, error) {
+	var parent string
+	if s.Parent.IsValid() {
+		parent = hex.EncodeToString(s.Parent.SpanID[:])
+	}
+	return json.Marshal(struct {
+		Name       string            `json:"name"`
+		TraceID    string            `json:"traceId"`
+		SpanID     string            `json:"spanId"`
+		ParentID   string            `json:"parentSpanId,omitempty"`
+		Start      time.Time         `json:"start"`
+		End        time.Time         `json:"end"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+	}{
+		Name:       s.Name,
+		TraceID:    hex.EncodeToString(s.Context.TraceID[:]),
+		SpanID:     hex.EncodeToString(s.Context.SpanID[:]),
+		ParentID:   parent,
+		Start:      s.Start,
+		End:        s.End,
+		Attributes: s.Attributes,
+	})
+}
+
+// Exporter sends finished spans somewhere, such as a file or a
+// tracing service. Export may be called from more than one goroutine
+// at once.
+type Exporter interface {
+	Export(Span) error
+}
+
+// JSONExporter writes each span as a line of JSON. It is mainly for
+// testing and for looking at traces locally.
+type JSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONExporter makes a JSONExporter that writes to w, which is
+// usually a file.
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// Export writes a span to the file.
+func (e *JSONExporter) Export(span Span) error {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+// Tracer is an Observer that makes a span for each transition and
+// each run of an output, and sends them to an Exporter. The spans
+// are linked so that an input's transition is the child of the
+// output that sent the input, and each output is the child of the
+// transition that returned it. A Waiter that has been waiting for
+// too long is reported as a span covering the time it has waited.
+type Tracer struct {
+	exporter Exporter
+
+	mu      sync.Mutex
+	running map[[8]byte]Span
+	err     error
+}
+
+// NewTracer makes a Tracer that sends its spans to the exporter.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{
+		exporter: exporter,
+		running:  make(map[[8]byte]Span),
+	}
+}
+
+// Observe turns Events into spans.
+func (t *Tracer) Observe(event Event) {
+	switch e := event.(type) {
+	case Transition:
+		attributes := map[string]string{"gu.in": typeName(e.In)}
+		if e.Waiter != nil {
+			attributes["gu.waiter"] = typeName(e.Waiter)
+		}
+		t.export(Span{
+			Name:       "transition " + typeName(e.In),
+			Context:    e.Span,
+			Parent:     e.Parent,
+			Start:      e.Start,
+			End:        e.End,
+			Attributes: attributes,
+		})
+
+	case OutputStarted:
+		t.mu.Lock()
+		t.running[e.Span.SpanID] = Span{
+			Name:       "output " + typeName(e.Out),
+			Context:    e.Span,
+			Parent:     e.Parent,
+			Start:      e.Time,
+			Attributes: map[string]string{"gu.out": typeName(e.Out)},
+		}
+		t.mu.Unlock()
+
+	case OutputReturned:
+		t.mu.Lock()
+		span, ok := t.running[e.Span.SpanID]
+		delete(t.running, e.Span.SpanID)
+		t.mu.Unlock()
+		if ok {
+			span.End = e.Time
+			t.export(span)
+		}
+
+	case WaiterAged:
+		t.export(Span{
+			Name:       "waiter aged " + typeName(e.Waiter),
+			Context:    SpanContext{}.newChild(),
+			Start:      e.Since,
+			End:        e.Time,
+			Attributes: map[string]string{"gu.waiter": typeName(e.Waiter)},
+		})
+	}
+}
+
+// Err returns the first error from the Exporter, if there was one.
+func (t *Tracer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *Tracer) export(span Span) {
+	err := t.exporter.Export(span)
+	if err == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
@@ -0,0 +1,132 @@
+package gu
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// spans is an Exporter that keeps the spans.
+type spans struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (s *spans) Export(span Span) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans = append(s.spans, span)
+	return nil
+}
+
+func (s *spans) named(name string) []Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []Span
+	for _, span := range s.spans {
+		if span.Name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+// remote is an input that carries a trace from outside.
+type remote struct{ traceparent string }
+
+func (remote) Router(Waiter) Ready { return nil }
+
+func (remote) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.n++
+	return c, nil
+}
+
+func (r remote) Traceparent() string { return r.traceparent }
+
+func TestTracer(t *testing.T) {
+	exported := &spans{}
+	parent := SpanContext{}.newChild()
+	p := Start(start{
+		state:     count{limit: 2},
+		outputs:   []Out{send{inc{}}, send{remote{parent.Traceparent()}}},
+		observers: []Observer{NewTracer(exported)},
+	})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+
+	// Each output's span is a child of the input sent by it.
+	outputs := exported.named("output gu.send")
+	transitions := exported.named("transition gu.inc")
+	if len(transitions) != 1 {
+		t.Fatalf("got %d transitions for gu.inc", len(transitions))
+	}
+	found := false
+	for _, output := range outputs {
+		if output.Context == transitions[0].Parent {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("transition %+v isn't a child of an output in %+v", transitions[0], outputs)
+	}
+	if transitions[0].Attributes["gu.in"] != "gu.inc" {
+		t.Errorf("attributes are %v", transitions[0].Attributes)
+	}
+
+	// The remote trace is carried on.
+	remotes := exported.named("transition gu.remote")
+	if len(remotes) != 1 || remotes[0].Parent != parent || remotes[0].Context.TraceID != parent.TraceID {
+		t.Errorf("remote transitions are %+v, expected a child of %+v", remotes, parent)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	c := SpanContext{}.newChild()
+	parsed, err := ParseTraceparent(c.Traceparent())
+	if err != nil || parsed != c {
+		t.Errorf("got %+v, %v, expected %+v", parsed, err, c)
+	}
+
+	h := http.Header{}
+	SetTraceparent(h, c)
+	if h.Get(TraceparentHeader) != c.Traceparent() {
+		t.Errorf("header is %q", h.Get(TraceparentHeader))
+	}
+	SetTraceparent(h, SpanContext{})
+	if h.Get(TraceparentHeader) != c.Traceparent() {
+		t.Error("an invalid span replaced the header")
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	c := SpanContext{}.newChild()
+	err := NewJSONExporter(&buf).Export(Span{Name: "transition gu.inc", Context: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), c.Traceparent()[3:35]) || line["name"] != "transition gu.inc" {
+		t.Errorf("wrote %s", buf.String())
+	}
+}
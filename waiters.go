@@ -0,0 +1,116 @@
+package gu
+
+// Keeping every Waiter in the state means that each Ready.Update has
+// to remember to take its own Waiter out of the state again. The
+// runtime can keep waiters instead, which is done by returning the
+// outputs made by WaitOnce, WaitAlways and StopWaiting from an update
+// or from Init.InitOutputs. These are instructions to the main loop
+// rather than IO actions, so they are not run like other outputs.
+
+// WaitOnce returns an instruction to the main loop to keep a Waiter
+// until it has claimed one input, and then to remove it.
+func WaitOnce(waiter Waiter) Out {
+	return directive(func(m *machine) {
+		m.keep(keptWaiter{waiter: waiter, once: true})
+	})
+}
+
+// WaitAlways returns an instruction to the main loop to keep a Waiter
+// until StopWaiting is given the same key. It replaces any Waiter
+// already kept with that key. If the Waiter is Finite, such as a Flow
+// or a Join, then it is also removed once it is Done.
+func WaitAlways(key string, waiter Waiter) Out {
+	return directive(func(m *machine) {
+		m.removeKept(func(old keptWaiter) bool {
+			return !old.once && old.key == key
+		})
+		m.keep(keptWaiter{key: key, waiter: waiter})
+	})
+}
+
+// StopWaiting returns an instruction to the main loop to remove the
+// Waiter kept by WaitAlways with the key.
+func StopWaiting(key string) Out {
+	return directive(func(m *machine) {
+		m.removeKept(func(kept keptWaiter) bool {
+			return !kept.once && kept.key == key
+		})
+	})
+}
+
+// Finite is an optional interface for a Waiter kept with WaitAlways.
+// The main loop removes it once Done returns true.
+type Finite interface {
+	Done() bool
+}
+
+type keptWaiter struct {
+	key    string
+	once   bool
+	waiter Waiter
+
+	// id tells apart the Waiters kept by the main loop.
+	id keptID
+}
+
+type keptID uint64
+
+// directive is an Out that is an instruction to the main loop. It is
+// carried out when it is returned from an update, so its Io is never
+// run by the main loop.
+type directive func(*machine)
+
+func (directive) Io(chan In) {}
+
+func (directive) Fast() bool {
+	return true
+}
+
+// direct carries out the directives in the outputs, and returns the
+// other outputs.
+func (m *machine) direct(outputs []Out) []Out {
+	var others []Out
+	for _, output := range outputs {
+		if d, ok := output.(directive); ok {
+			d(m)
+		} else {
+			others = append(others, output)
+		}
+	}
+	return others
+}
+
+// tidy removes the kept Waiters that are Done.
+func (m *machine) tidy() {
+	m.removeKept(func(kept keptWaiter) bool {
+		finite, ok := kept.waiter.(Finite)
+		return ok && finite.Done()
+	})
+}
+
+// keep adds to the kept Waiters. The list is copied rather than
+// changed, as it may be shared with an older machine.
+func (m *machine) keep(kept keptWaiter) {
+	m.nextID++
+	kept.id = m.nextID
+	n := len(m.waiters)
+	m.waiters = append(m.waiters[:n:n], kept)
+}
+
+// removeKept removes the kept Waiters that match. Like keep, it
+// copies the list.
+func (m *machine) removeKept(remove func(keptWaiter) bool) {
+	for i, w := range m.waiters {
+		if !remove(w) {
+			continue
+		}
+		kept := append([]keptWaiter{}, m.waiters[:i]...)
+		for _, w := range m.waiters[i+1:] {
+			if !remove(w) {
+				kept = append(kept, w)
+			}
+		}
+		m.waiters = kept
+		return
+	}
+}
@@ -0,0 +1,85 @@
+package gu
+
+import (
+	"slices"
+	"testing"
+)
+
+// bonus is a Waiter for the answer with its key, which adds ten to
+// the count instead of one.
+type bonus struct{ key string }
+
+func (b bonus) Expected(in In) (Ready, bool) {
+	if a, ok := in.(answer); ok && a.key == b.key {
+		return b, true
+	}
+	return nil, false
+}
+
+func (bonus) Update(s State) (State, []Out) {
+	c := s.(count)
+	c.n += 10
+	return c, nil
+}
+
+// direct is an input whose update returns its outputs.
+type direct []Out
+
+func (direct) Router(Waiter) Ready { return nil }
+
+func (d direct) Update(s State) (State, []Out) { return s, d }
+
+// counts applies the inputs and returns the count after each.
+func counts(m *Machine, inputs ...In) []int {
+	var n []int
+	for _, in := range inputs {
+		m.Apply(in)
+		n = append(n, m.State().(count).n)
+	}
+	return n
+}
+
+func TestWaitOnce(t *testing.T) {
+	m, outputs := NewMachine(start{state: count{}, outputs: []Out{WaitOnce(bonus{"a"})}})
+	if len(outputs) != 0 {
+		t.Errorf("the directive was returned as an output")
+	}
+	got := counts(m, answer{"b"}, answer{"a"}, answer{"a"})
+	if !slices.Equal(got, []int{1, 11, 12}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestWaitAlways(t *testing.T) {
+	m, _ := NewMachine(start{state: count{}})
+	got := counts(m,
+		direct{WaitAlways("k", bonus{"a"})},
+		answer{"a"}, answer{"a"},
+		// A second Waiter with the same key replaces the first.
+		direct{WaitAlways("k", bonus{"b"})},
+		answer{"a"}, answer{"b"},
+		direct{StopWaiting("k")},
+		answer{"b"},
+	)
+	if !slices.Equal(got, []int{0, 10, 20, 20, 21, 31, 31, 32}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestWaitAlwaysFinite(t *testing.T) {
+	then := func(s State, _ Results, ok bool) (State, []Out) {
+		c := s.(count)
+		c.n += 100
+		return c, nil
+	}
+	m, _ := NewMachine(start{state: count{}, outputs: []Out{
+		WaitAlways("join", All(then, reply("x"))),
+	}})
+	got := counts(m, word("x"), word("x"))
+	if !slices.Equal(got, []int{100, 100}) {
+		t.Errorf("got %v", got)
+	}
+	if len(m.m.waiters) != 0 {
+		t.Errorf("the done Join is still kept: %v", m.m.waiters)
+	}
+}
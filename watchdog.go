@@ -0,0 +1,156 @@
+package gu
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Watchdog is an Observer that notices when the main loop gets stuck.
+// The whole program stops if an update does something slow, or a
+// Fast output blocks, so the Watchdog checks in its own goroutine
+// how long the current step has been running. If it runs for longer
+// than the threshold then the Watchdog writes a report with the
+// stacks of all the goroutines, and can crash the program.
+//
+// The main loop waiting for a new input is not counted as a step,
+// so a quiet program doesn't set off the Watchdog.
+//
+// A Watchdog watches one program at a time, but it can be given to
+// another once the first has stopped.
+type Watchdog struct {
+	threshold time.Duration
+	w         io.Writer
+	fatal     bool
+
+	mu sync.Mutex
+	// stop is closed to end the goroutine that checks the step,
+	// which is running if it isn't nil.
+	stop chan struct{}
+	// step describes what the main loop is doing, or is "" when it
+	// is waiting for an input.
+	step      string
+	stepStart time.Time
+	reported  bool
+	in        In
+	lastEnd   time.Time
+}
+
+// NewWatchdog makes a Watchdog that writes to w when a step runs for
+// longer than the threshold, which must be positive. If fatal is true
+// it then panics, which crashes the program. The panic is in the
+// Watchdog's own goroutine, because the main loop is stuck, so it
+// can't be recovered and the Observers aren't sent a Panicked event
+// for it; the report written to w is the record of what happened.
+func NewWatchdog(threshold time.Duration, w io.Writer, fatal bool) *Watchdog {
+	if threshold <= 0 {
+		panic("gu: watchdog threshold must be positive")
+	}
+	return &Watchdog{
+		threshold: threshold,
+		w:         w,
+		fatal:     fatal,
+	}
+}
+
+// Observe keeps track of which step the main loop is running.
+func (d *Watchdog) Observe(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stop == nil {
+		d.stop = make(chan struct{})
+		go d.watch(d.stop)
+	}
+
+	switch e := event.(type) {
+	case Received:
+		d.in = e.In
+		d.begin("update of "+typeName(e.In), e.Time)
+
+	case Transition:
+		d.step = ""
+		d.lastEnd = e.End
+
+	case OutputStarted:
+		if e.Out.Fast() {
+			d.begin("Fast output "+typeName(e.Out), e.Time)
+		}
+
+	case OutputReturned:
+		if e.Out.Fast() {
+			d.step = ""
+		}
+
+	case Stopped:
+		d.step = ""
+		d.in = nil
+		d.lastEnd = time.Time{}
+		close(d.stop)
+		d.stop = nil
+	}
+}
+
+func (d *Watchdog) begin(step string, start time.Time) {
+	d.step = step
+	d.stepStart = start
+	d.reported = false
+}
+
+// minWatchdogTick is the shortest time between the Watchdog's checks.
+const minWatchdogTick = time.Millisecond
+
+func (d *Watchdog) watch(stop chan struct{}) {
+	ticker := time.NewTicker(max(d.threshold/4, minWatchdogTick))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			d.check(now)
+		}
+	}
+}
+
+func (d *Watchdog) check(now time.Time) {
+	d.mu.Lock()
+	stuck := d.step != "" && !d.reported && now.Sub(d.stepStart) > d.threshold
+	if !stuck {
+		d.mu.Unlock()
+		return
+	}
+	d.reported = true
+	report := fmt.Sprintf(
+		"gu: watchdog: %s has been running for %s\n",
+		d.step, now.Sub(d.stepStart).Round(time.Millisecond))
+	if d.in != nil {
+		report += fmt.Sprintf("gu: watchdog: current input is %s\n", typeName(d.in))
+	}
+	if !d.lastEnd.IsZero() {
+		report += fmt.Sprintf(
+			"gu: watchdog: last transition finished %s ago\n",
+			now.Sub(d.lastEnd).Round(time.Millisecond))
+	}
+	d.mu.Unlock()
+
+	io.WriteString(d.w, report+"\n"+string(allStacks())+"\n")
+	if d.fatal {
+		panic(report)
+	}
+}
+
+// allStacks returns the stack traces of all the goroutines.
+func allStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
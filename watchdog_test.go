@@ -0,0 +1,97 @@
+package gu
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slow is a Fast output that blocks the main loop for a while.
+type slow struct{ d time.Duration }
+
+func (s slow) Io(ch chan In) {
+	time.Sleep(s.d)
+	ch <- inc{}
+}
+
+func (slow) Fast() bool { return true }
+
+// syncBuffer is a bytes.Buffer that is safe to write to from more
+// than one goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatchdog(t *testing.T) {
+	for _, threshold := range []time.Duration{time.Nanosecond, 20 * time.Millisecond} {
+		var buf syncBuffer
+		p := Start(start{
+			state:     count{limit: 1},
+			outputs:   []Out{slow{100 * time.Millisecond}},
+			observers: []Observer{NewWatchdog(threshold, &buf, false)},
+		})
+		if err := wait(t, p); err != errDone {
+			t.Fatalf("got %v", err)
+		}
+		if !strings.Contains(buf.String(), "Fast output gu.slow has been running") {
+			t.Errorf("with threshold %s, report is %q", threshold, buf.String())
+		}
+	}
+}
+
+func TestWatchdogQuiet(t *testing.T) {
+	var buf syncBuffer
+	p := Start(start{
+		state:     count{limit: 1},
+		outputs:   []Out{slow{0}},
+		observers: []Observer{NewWatchdog(time.Second, &buf, false)},
+	})
+	if err := wait(t, p); err != errDone {
+		t.Fatalf("got %v", err)
+	}
+	if buf.String() != "" {
+		t.Errorf("unexpected report %q", buf.String())
+	}
+}
+
+func TestWatchdogReused(t *testing.T) {
+	var buf syncBuffer
+	d := NewWatchdog(20*time.Millisecond, &buf, false)
+	for i := 0; i < 2; i++ {
+		p := Start(start{
+			state:     count{limit: 1},
+			outputs:   []Out{slow{100 * time.Millisecond}},
+			observers: []Observer{d},
+		})
+		if err := wait(t, p); err != errDone {
+			t.Fatalf("got %v", err)
+		}
+		if n := strings.Count(buf.String(), "Fast output gu.slow has been running"); n != i+1 {
+			t.Errorf("after run %d there are %d reports", i+1, n)
+		}
+	}
+}
+
+func TestWatchdogBadThreshold(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	NewWatchdog(0, &bytes.Buffer{}, false)
+}